@@ -0,0 +1,130 @@
+package camo
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hasCachePolicy reports whether any Cache-Control policy is configured.
+func (c *Config) hasCachePolicy() bool {
+	return c.CacheMinTTL > 0 || c.CacheMaxTTL > 0 || c.CacheDefaultTTL > 0 ||
+		c.CacheRewritePrivate
+}
+
+// clampTTL applies the configured min/max ttl bounds to ttl.
+func (c *Config) clampTTL(ttl time.Duration) time.Duration {
+	if c.CacheMinTTL > 0 && ttl < c.CacheMinTTL {
+		ttl = c.CacheMinTTL
+	}
+	if c.CacheMaxTTL > 0 && ttl > c.CacheMaxTTL {
+		ttl = c.CacheMaxTTL
+	}
+	return ttl
+}
+
+// applyCachePolicy normalizes the Cache-Control and Expires headers of an
+// image response (already copied into h) according to the configured
+// cache policy. now is used to turn an upstream Expires into a lifetime, and
+// to compute the new Expires.
+func (c *Config) applyCachePolicy(h http.Header, now time.Time) {
+	if !c.hasCachePolicy() {
+		return
+	}
+
+	var directives []string
+	var ttl time.Duration
+	hasTTL := false
+	noStore := false
+	private := false
+
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name := strings.ToLower(d)
+			if i := strings.Index(name, "="); i >= 0 {
+				name = name[:i]
+			}
+			switch name {
+			case "max-age", "s-maxage":
+				// only max-age is used to determine the ttl, but both are
+				// dropped and rewritten below so a CDN honoring s-maxage
+				// can't escape the clamping.
+				if name == "max-age" && len(d) > len(name)+1 {
+					secs, err := strconv.ParseInt(strings.Trim(d[len(name)+1:], `"`), 10, 64)
+					if err == nil && secs >= 0 {
+						ttl = time.Duration(secs) * time.Second
+						hasTTL = true
+					}
+				}
+				continue
+			case "no-store":
+				noStore = true
+			case "private":
+				private = true
+			}
+			directives = append(directives, d)
+		}
+	}
+
+	if noStore || private {
+		if !c.CacheRewritePrivate {
+			// respect upstream wishes, but still clamp a max-age if one was
+			// provided alongside private.
+			if noStore || !hasTTL {
+				return
+			}
+		} else {
+			kept := directives[:0]
+			for _, d := range directives {
+				switch strings.ToLower(d) {
+				case "no-store", "private", "public":
+					continue
+				}
+				kept = append(kept, d)
+			}
+			directives = append([]string{"public"}, kept...)
+			private = false
+			// a no-store response carries no meaningful lifetime
+			if noStore {
+				hasTTL = false
+			}
+		}
+	}
+
+	// fall back to Expires if no max-age was given
+	if !hasTTL {
+		if exp := h.Get("Expires"); exp != "" {
+			if t, err := http.ParseTime(exp); err == nil {
+				ttl = t.Sub(now)
+				if ttl < 0 {
+					ttl = 0
+				}
+			}
+			// an invalid Expires value means already expired (rfc7234 5.3)
+			hasTTL = true
+		}
+	}
+
+	if !hasTTL {
+		if c.CacheDefaultTTL <= 0 {
+			if !c.CacheRewritePrivate || len(directives) == 0 {
+				return
+			}
+			h.Set("Cache-Control", strings.Join(directives, ", "))
+			return
+		}
+		ttl = c.CacheDefaultTTL
+	}
+
+	ttl = c.clampTTL(ttl)
+	directives = append(directives, "max-age="+strconv.FormatInt(int64(ttl/time.Second), 10))
+	h.Set("Cache-Control", strings.Join(directives, ", "))
+	if !private {
+		h.Set("Expires", now.Add(ttl).UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,76 @@
+package camo
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type cachetesto struct {
+	config       Config
+	cacheControl string
+	expires      string
+	wantCC       string
+	wantExpires  string
+}
+
+var cacheNow = time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC)
+
+var cachetests = []cachetesto{
+	// no policy, headers untouched
+	{Config{}, "private, max-age=5", "", "private, max-age=5", ""},
+	// clamp up
+	{Config{CacheMinTTL: time.Hour}, "public, max-age=5", "",
+		"public, max-age=3600", "Tue, 01 Jul 2014 13:00:00 GMT"},
+	// clamp down, s-maxage dropped
+	{Config{CacheMaxTTL: time.Hour}, "max-age=31536000, s-maxage=31536000", "",
+		"max-age=3600", "Tue, 01 Jul 2014 13:00:00 GMT"},
+	// in range
+	{Config{CacheMinTTL: time.Minute, CacheMaxTTL: time.Hour}, "max-age=120", "",
+		"max-age=120", "Tue, 01 Jul 2014 12:02:00 GMT"},
+	// default when nothing given
+	{Config{CacheDefaultTTL: time.Hour}, "", "",
+		"max-age=3600", "Tue, 01 Jul 2014 13:00:00 GMT"},
+	// no default, nothing given
+	{Config{CacheMaxTTL: time.Hour}, "", "", "", ""},
+	// expires only, clamped
+	{Config{CacheMaxTTL: time.Hour}, "", "Wed, 02 Jul 2014 12:00:00 GMT",
+		"max-age=3600", "Tue, 01 Jul 2014 13:00:00 GMT"},
+	// invalid expires is already expired
+	{Config{CacheMinTTL: time.Minute}, "", "0",
+		"max-age=60", "Tue, 01 Jul 2014 12:01:00 GMT"},
+	// no-store respected without rewrite
+	{Config{CacheMinTTL: time.Hour}, "no-store", "", "no-store", ""},
+	// private max-age still clamped without rewrite
+	{Config{CacheMinTTL: time.Hour}, "private, max-age=5", "",
+		"private, max-age=3600", ""},
+	// private rewritten
+	{Config{CacheRewritePrivate: true, CacheDefaultTTL: time.Hour}, "private", "",
+		"public, max-age=3600", "Tue, 01 Jul 2014 13:00:00 GMT"},
+	// no-store rewritten, upstream max-age ignored
+	{Config{CacheRewritePrivate: true, CacheDefaultTTL: time.Hour}, "no-store, max-age=0", "",
+		"public, max-age=3600", "Tue, 01 Jul 2014 13:00:00 GMT"},
+	// rewrite without a default ttl
+	{Config{CacheRewritePrivate: true}, "private, no-transform", "",
+		"public, no-transform", ""},
+}
+
+func TestApplyCachePolicy(t *testing.T) {
+	t.Parallel()
+	for _, p := range cachetests {
+		h := http.Header{}
+		if p.cacheControl != "" {
+			h.Set("Cache-Control", p.cacheControl)
+		}
+		if p.expires != "" {
+			h.Set("Expires", p.expires)
+		}
+		p.config.applyCachePolicy(h, cacheNow)
+		assert.Equal(t, p.wantCC, h.Get("Cache-Control"), "Cache-Control mismatch for %q", p.cacheControl)
+		if p.wantExpires != "" {
+			assert.Equal(t, p.wantExpires, h.Get("Expires"), "Expires mismatch for %q", p.cacheControl)
+		}
+	}
+}
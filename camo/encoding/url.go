@@ -6,9 +6,8 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
+	"log/slog"
 	"strings"
-
-	"github.com/cactus/gologit"
 )
 
 func validateURL(hmackey *[]byte, macbytes *[]byte, urlbytes *[]byte) bool {
@@ -16,14 +15,15 @@ func validateURL(hmackey *[]byte, macbytes *[]byte, urlbytes *[]byte) bool {
 	mac.Write(*urlbytes)
 	macSum := mac.Sum(nil)
 
-	// ensure lengths are equal. if not, return false
+	// ensure lengths are equal. if not, return false.
+	// the expected mac is not logged, as it is a valid signature for the url.
 	if len(macSum) != len(*macbytes) {
-		gologit.Debugf("Bad signature: %x != %x\n", macSum, macbytes)
+		slog.Debug("bad signature length", "signature", hex.EncodeToString(*macbytes))
 		return false
 	}
 
 	if subtle.ConstantTimeCompare(macSum, *macbytes) != 1 {
-		gologit.Debugf("Bad signature: %x != %x\n", macSum, macbytes)
+		slog.Debug("bad signature", "signature", hex.EncodeToString(*macbytes))
 		return false
 	}
 	return true
@@ -48,12 +48,12 @@ func b64decode(str string) ([]byte, error) {
 func HexDecodeURL(hmackey []byte, hexdig string, hexURL string) (string, bool) {
 	urlBytes, err := hex.DecodeString(hexURL)
 	if err != nil {
-		gologit.Debugln("Bad Hex Decode of URL", hexURL)
+		slog.Debug("bad hex decode of url", "url", hexURL)
 		return "", false
 	}
 	macBytes, err := hex.DecodeString(hexdig)
 	if err != nil {
-		gologit.Debugln("Bad Hex Decode of MAC", hexURL)
+		slog.Debug("bad hex decode of mac", "url", hexURL)
 		return "", false
 	}
 
@@ -81,12 +81,12 @@ func HexEncodeURL(hmacKey []byte, oURL string) string {
 func B64DecodeURL(hmackey []byte, encdig string, encURL string) (string, bool) {
 	urlBytes, err := b64decode(encURL)
 	if err != nil {
-		gologit.Debugln("Bad B64 Decode of URL", encURL)
+		slog.Debug("bad b64 decode of url", "url", encURL)
 		return "", false
 	}
 	macBytes, err := b64decode(encdig)
 	if err != nil {
-		gologit.Debugln("Bad B64 Decode of MAC", encURL)
+		slog.Debug("bad b64 decode of mac", "url", encURL)
 		return "", false
 	}
 
@@ -121,7 +121,7 @@ func DecodeURL(hmackey []byte, encdig string, encURL string) (string, bool) {
 
 	urlBytes, ok := decoder(hmackey, encdig, encURL)
 	if !ok {
-		gologit.Debugln("Bad Decode of URL", encURL)
+		slog.Debug("bad decode of url", "url", encURL)
 		return "", false
 	}
 	return string(urlBytes), true
@@ -0,0 +1,136 @@
+package camo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Reason is a machine readable classification of why a request was rejected
+// or could not be served.
+type Reason int
+
+// Reasons returned by the Proxy. The string form of each (see Reason.String)
+// is sent to clients in the X-Camo-Error response header.
+const (
+	ReasonNone Reason = iota
+	ReasonRequestLoop
+	ReasonBadPath
+	ReasonBadSignature
+	ReasonBadURL
+	ReasonBadHost
+	ReasonAllowList
+	ReasonDenyList
+	ReasonTooLarge
+	ReasonBadContentType
+	ReasonTooManyRedirects
+	ReasonUpstreamStatus
+	ReasonUpstreamTimeout
+	ReasonDNSFailure
+	ReasonTLSFailure
+	ReasonConnectionRefused
+	ReasonUpstreamClosed
+	ReasonUpstreamError
+	numReasons
+)
+
+// NumReasons is the number of defined Reason values, including ReasonNone.
+// It is useful for sizing arrays indexed by Reason.
+const NumReasons = int(numReasons)
+
+var reasonStrings = [NumReasons]string{
+	ReasonNone:              "none",
+	ReasonRequestLoop:       "request-loop",
+	ReasonBadPath:           "bad-path",
+	ReasonBadSignature:      "bad-signature",
+	ReasonBadURL:            "bad-url",
+	ReasonBadHost:           "bad-host",
+	ReasonAllowList:         "allow-list",
+	ReasonDenyList:          "deny-list",
+	ReasonTooLarge:          "too-large",
+	ReasonBadContentType:    "bad-content-type",
+	ReasonTooManyRedirects:  "too-many-redirects",
+	ReasonUpstreamStatus:    "upstream-status",
+	ReasonUpstreamTimeout:   "upstream-timeout",
+	ReasonDNSFailure:        "dns-failure",
+	ReasonTLSFailure:        "tls-failure",
+	ReasonConnectionRefused: "connection-refused",
+	ReasonUpstreamClosed:    "upstream-closed",
+	ReasonUpstreamError:     "upstream-error",
+}
+
+func (r Reason) String() string {
+	if r < 0 || r >= numReasons {
+		return "unknown"
+	}
+	return reasonStrings[r]
+}
+
+// A ProxyError describes a failed proxy request.
+type ProxyError struct {
+	// Reason classifies the failure
+	Reason Reason
+	// Code is the HTTP status code returned to the client
+	Code int
+	// Msg is the plain text message returned to the client
+	Msg string
+	// Err is the underlying error, if any
+	Err error
+}
+
+func newProxyError(reason Reason, code int, msg string, err error) *ProxyError {
+	return &ProxyError{Reason: reason, Code: code, Msg: msg, Err: err}
+}
+
+func (e *ProxyError) Error() string {
+	if e.Err != nil {
+		return e.Reason.String() + ": " + e.Msg + ": " + e.Err.Error()
+	}
+	return e.Reason.String() + ": " + e.Msg
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// errTooManyRedirects is returned by the http client redirect policy when
+// MaxRedirects is exceeded.
+var errTooManyRedirects = errors.New("Too many redirects")
+
+// classifyUpstreamError determines the Reason for an error returned when
+// fetching from upstream, by unwrapping it down to the underlying error
+// types.
+func classifyUpstreamError(err error) Reason {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCertErr x509.CertificateInvalidError
+
+	switch {
+	case errors.Is(err, errTooManyRedirects):
+		return ReasonTooManyRedirects
+	case errors.As(err, &dnsErr):
+		return ReasonDNSFailure
+	case errors.As(err, &certErr), errors.As(err, &recordErr),
+		errors.As(err, &alertErr), errors.As(err, &unknownAuthErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidCertErr):
+		return ReasonTLSFailure
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonUpstreamTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonConnectionRefused
+	case errors.Is(err, net.ErrClosed), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ReasonUpstreamClosed
+	}
+	return ReasonUpstreamError
+}
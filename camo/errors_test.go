@@ -0,0 +1,78 @@
+package camo
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func wrapUpstream(err error) error {
+	// mimic what http.Client.Do returns for transport level failures
+	return &url.Error{Op: "Get", URL: "http://example.com/", Err: err}
+}
+
+func opError(err error) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+}
+
+type classifytesto struct {
+	err    error
+	reason Reason
+}
+
+var classifytests = []classifytesto{
+	{wrapUpstream(errTooManyRedirects), ReasonTooManyRedirects},
+	{wrapUpstream(opError(&net.DNSError{Err: "no such host", Name: "flabergasted.cx"})), ReasonDNSFailure},
+	{wrapUpstream(x509.UnknownAuthorityError{}), ReasonTLSFailure},
+	{wrapUpstream(x509.HostnameError{Host: "example.com"}), ReasonTLSFailure},
+	{wrapUpstream(opError(timeoutError{})), ReasonUpstreamTimeout},
+	{wrapUpstream(opError(os.NewSyscallError("connect", syscall.ECONNREFUSED))), ReasonConnectionRefused},
+	{wrapUpstream(opError(os.NewSyscallError("read", syscall.ECONNRESET))), ReasonUpstreamClosed},
+	{wrapUpstream(opError(net.ErrClosed)), ReasonUpstreamClosed},
+	{wrapUpstream(io.ErrUnexpectedEOF), ReasonUpstreamClosed},
+	{wrapUpstream(errors.New("something else")), ReasonUpstreamError},
+}
+
+func TestClassifyUpstreamError(t *testing.T) {
+	t.Parallel()
+	for _, p := range classifytests {
+		assert.Equal(t, p.reason, classifyUpstreamError(p.err), "wrong reason for '%s'", p.err)
+	}
+}
+
+func TestClassifyConnectionRefused(t *testing.T) {
+	t.Parallel()
+	// grab a free port, then close it so nothing is listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = http.Get(fmt.Sprintf("http://%s/", addr))
+	assert.NotNil(t, err)
+	assert.Equal(t, ReasonConnectionRefused, classifyUpstreamError(err))
+}
+
+func TestReasonString(t *testing.T) {
+	t.Parallel()
+	for r := ReasonNone; r < numReasons; r++ {
+		assert.NotEqual(t, "", r.String(), "missing string for reason %d", r)
+	}
+	assert.Equal(t, "unknown", Reason(-1).String())
+	assert.Equal(t, "unknown", numReasons.String())
+}
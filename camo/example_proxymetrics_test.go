@@ -2,36 +2,29 @@ package camo_test
 
 import (
 	"log"
-	"sync"
+	"sync/atomic"
 
 	"github.com/cactus/go-camo/camo"
 )
 
 type ProxyStats struct {
-	sync.RWMutex
-	clients uint64
-	bytes   uint64
+	clients atomic.Uint64
+	bytes   atomic.Uint64
 }
 
 func (ps *ProxyStats) AddServed() {
-	ps.Lock()
-	ps.clients++
-	ps.Unlock()
+	ps.clients.Add(1)
 }
 
 func (ps *ProxyStats) AddBytes(bc int64) {
 	if bc <= 0 {
 		return
 	}
-	ps.Lock()
-	ps.bytes += uint64(bc)
-	ps.Unlock()
+	ps.bytes.Add(uint64(bc))
 }
 
 func (ps *ProxyStats) GetStats() (uint64, uint64) {
-	ps.RLock()
-	defer ps.RUnlock()
-	return ps.bytes, ps.clients
+	return ps.bytes.Load(), ps.clients.Load()
 }
 
 func ExampleProxyMetrics() {
@@ -0,0 +1,184 @@
+package camo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cactus/go-camo/camo/encoding"
+)
+
+// how long Explain waits for dns resolution
+const explainDNSTimeout = 2 * time.Second
+
+// ExplainCheck is the outcome of a single check made on a request
+type ExplainCheck struct {
+	Check  string `json:"check"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Explanation describes how a signed path would be handled by the Proxy,
+// as returned by Explain.
+type Explanation struct {
+	Path string `json:"path"`
+	URL  string `json:"url,omitempty"`
+	Host string `json:"host,omitempty"`
+	// Allowed is true if the request passed all checks, and would be
+	// fetched from upstream
+	Allowed bool `json:"allowed"`
+	// Reason and Status are the failure reason code and the status code
+	// that would be returned to the client, if not Allowed
+	Reason string         `json:"reason,omitempty"`
+	Status int            `json:"status,omitempty"`
+	Checks []ExplainCheck `json:"checks"`
+}
+
+func (ex *Explanation) add(check string, ok bool, detail string) {
+	if ex != nil {
+		ex.Checks = append(ex.Checks, ExplainCheck{check, ok, detail})
+	}
+}
+
+// checkURL runs a request path through the validation pipeline: path format,
+// signature, url parsing, host normalization, and the allow and deny lists.
+// u is returned once its host has been validated, even if a later check
+// fails. Each check is recorded to ex, if not nil.
+func (st *proxyState) checkURL(path string, timer *reqTimer, ex *Explanation) (sURL string, u *url.URL, perr *ProxyError) {
+	// split path and get components
+	timer.begin(phaseDecode)
+	components := strings.Split(path, "/")
+	if len(components) < 3 {
+		timer.finish(phaseDecode)
+		ex.add("path", false, "expected /<signature>/<encoded url>")
+		return "", nil, newProxyError(ReasonBadPath,
+			http.StatusNotFound, "Malformed request path", nil)
+	}
+	ex.add("path", true, "")
+	sigHash, encodedURL := components[1], components[2]
+
+	sURL, ok := encoding.DecodeURL(st.config.HMACKey, sigHash, encodedURL)
+	timer.finish(phaseDecode)
+	if !ok {
+		ex.add("signature", false, "signature does not match url, or url is badly encoded")
+		return "", nil, newProxyError(ReasonBadSignature,
+			http.StatusForbidden, "Bad Signature", nil)
+	}
+	ex.add("signature", true, "")
+
+	timer.begin(phasePolicy)
+	u, err := url.Parse(sURL)
+	if err != nil {
+		ex.add("url", false, err.Error())
+		return sURL, nil, newProxyError(ReasonBadURL, http.StatusBadRequest, "Bad url", err)
+	}
+	ex.add("url", true, sURL)
+
+	u.Host = strings.ToLower(u.Host)
+	if u.Host == "" || localhostRegex.MatchString(u.Host) {
+		ex.add("host", false, fmt.Sprintf("host '%s' is empty or localhost", u.Host))
+		return sURL, nil, newProxyError(ReasonBadHost, http.StatusNotFound, "Bad url host", nil)
+	}
+	ex.add("host", true, u.Host)
+
+	// if allowList is set, require match
+	matchFound := true
+	detail := "no allow list configured"
+	if len(st.allowList) > 0 {
+		matchFound = false
+		detail = "host matches no allow list entry"
+		for _, rgx := range st.allowList {
+			if rgx.MatchString(u.Host) {
+				matchFound = true
+				detail = "host matches " + rgx.String()
+				break
+			}
+		}
+	}
+	ex.add("allow-list", matchFound, detail)
+	if !matchFound {
+		return sURL, u, newProxyError(ReasonAllowList,
+			http.StatusNotFound, "Allowlist host failure", nil)
+	}
+
+	// filter out rfc1918 hosts
+	ip := net.ParseIP(u.Host)
+	if ip != nil {
+		if addr1918PrefixRegex.MatchString(ip.String()) {
+			ex.add("deny-list", false, "ip address is in a private or loopback range")
+			return sURL, u, newProxyError(ReasonDenyList,
+				http.StatusNotFound, "Denylist host failure", nil)
+		}
+	}
+	ex.add("deny-list", true, "")
+	return sURL, u, nil
+}
+
+// Explain runs path (a signed request path, eg. "/<sig>/<encoded url>")
+// through the same checks as ServeHTTP, plus a dns lookup of the host, and
+// returns the outcome of each. Nothing is fetched from upstream.
+func (p *Proxy) Explain(path string) *Explanation {
+	ex := &Explanation{Path: path}
+	sURL, u, perr := p.state.Load().checkURL(path, nil, ex)
+	ex.URL = sURL
+	if u != nil {
+		ex.Host = u.Host
+	}
+	if perr != nil {
+		ex.Reason = perr.Reason.String()
+		ex.Status = perr.Code
+		return ex
+	}
+	ex.Allowed = true
+
+	// the upstream transport resolves the host itself, so a failure here
+	// doesn't reject the request, but it will fail to fetch.
+	hostname := u.Hostname()
+	if net.ParseIP(hostname) != nil {
+		return ex
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), explainDNSTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, hostname)
+	if err != nil {
+		ex.add("dns", false, err.Error())
+		return ex
+	}
+	detail := strings.Join(addrs, ", ")
+	for _, addr := range addrs {
+		if addr1918PrefixRegex.MatchString(addr) {
+			detail += " (includes a private or loopback address, which the deny list only checks for ip literal urls)"
+			break
+		}
+	}
+	ex.add("dns", true, detail)
+	return ex
+}
+
+// ExplainHandler is an http.HandlerFunc that returns the Explanation for
+// the signed path in the path query parameter as json. A full camo url may
+// be given instead of just the path.
+func (p *Proxy) ExplainHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Missing path", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(path); err == nil && u.Scheme != "" {
+		path = u.Path
+	}
+
+	b, err := json.Marshal(p.Explain(path))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
@@ -0,0 +1,89 @@
+package camo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cactus/go-camo/camo/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func explainChecks(ex *Explanation) map[string]bool {
+	m := make(map[string]bool)
+	for _, c := range ex.Checks {
+		m[c.Check] = c.OK
+	}
+	return m
+}
+
+func TestExplain(t *testing.T) {
+	t.Parallel()
+	config := camoConfig
+	config.AllowList = []string{`^(.*\.)?example\.org$`, `^10\.`, `^8\.8\.8\.8$`}
+	camoServer, err := New(config)
+	assert.Nil(t, err)
+	sign := func(u string) string {
+		return encoding.B64EncodeURL(config.HMACKey, u)
+	}
+
+	ex := camoServer.Explain("/deadbeef")
+	assert.False(t, ex.Allowed)
+	assert.Equal(t, "bad-path", ex.Reason)
+	assert.Equal(t, 404, ex.Status)
+
+	ex = camoServer.Explain("/deadbeef/deadbeef")
+	assert.Equal(t, "bad-signature", ex.Reason)
+	assert.Equal(t, 403, ex.Status)
+	assert.Equal(t, map[string]bool{"path": true, "signature": false}, explainChecks(ex))
+
+	ex = camoServer.Explain(sign("http://LocalHost/foo.png"))
+	assert.Equal(t, "bad-host", ex.Reason)
+
+	ex = camoServer.Explain(sign("http://Example.COM/foo.png"))
+	assert.Equal(t, "allow-list", ex.Reason)
+	assert.Equal(t, "example.com", ex.Host)
+	assert.Equal(t, "http://Example.COM/foo.png", ex.URL)
+
+	ex = camoServer.Explain(sign("http://10.0.0.1/foo.png"))
+	assert.Equal(t, "deny-list", ex.Reason)
+	assert.Equal(t, map[string]bool{"path": true, "signature": true, "url": true,
+		"host": true, "allow-list": true, "deny-list": false}, explainChecks(ex))
+	assert.Equal(t, `host matches ^10\.`, ex.Checks[4].Detail)
+
+	// ip literal, so no dns lookup
+	ex = camoServer.Explain(sign("http://8.8.8.8/foo.png"))
+	assert.True(t, ex.Allowed)
+	assert.Equal(t, "", ex.Reason)
+	assert.Equal(t, 6, len(ex.Checks))
+}
+
+func TestExplainHandler(t *testing.T) {
+	t.Parallel()
+	camoServer, err := New(camoConfig)
+	assert.Nil(t, err)
+	path := encoding.B64EncodeURL(camoConfig.HMACKey, "http://10.0.0.1/foo.png")
+
+	// full camo urls are accepted too
+	for _, p := range []string{path, "https://camo.example.net" + path} {
+		req, err := http.NewRequest("GET", "http://example.com/explain?path="+url.QueryEscape(p), nil)
+		assert.Nil(t, err)
+		record := httptest.NewRecorder()
+		camoServer.ExplainHandler(record, req)
+		assert.Equal(t, 200, record.Code)
+		assert.Equal(t, "application/json", record.Header().Get("Content-Type"))
+
+		var ex Explanation
+		assert.Nil(t, json.Unmarshal(record.Body.Bytes(), &ex))
+		assert.Equal(t, path, ex.Path)
+		assert.Equal(t, "deny-list", ex.Reason)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/explain", nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	camoServer.ExplainHandler(record, req)
+	assert.Equal(t, 400, record.Code)
+}
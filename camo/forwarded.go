@@ -0,0 +1,88 @@
+package camo
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedChain returns the X-Forwarded-For chain of req, as sent by the
+// client and any proxies, with the connecting address (req.RemoteAddr)
+// appended. Peers that aren't connected over IP (eg. a local proxy on a unix
+// domain socket) are not appended.
+func forwardedChain(req *http.Request) []string {
+	var chain []string
+	for _, v := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				chain = append(chain, hop)
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		chain = append(chain, host)
+	} else if net.ParseIP(req.RemoteAddr) != nil {
+		chain = append(chain, req.RemoteAddr)
+	}
+	return chain
+}
+
+// clientIndex returns the index of the client address in a forwarded chain,
+// and whether it was found. Hops left of the index could have been made up
+// by the client, and are not to be relied on (or passed on).
+//
+// The chain is walked from the right (the nearest hop) for as long as the
+// hops are trusted proxies, and the first untrusted address is taken as the
+// client. If a trusted proxy reports an unparsable hop (eg. "unknown") as
+// its peer, the client is unknown, and the index is that of the proxy.
+func clientIndex(chain []string, trusted []*net.IPNet) (int, bool) {
+	if len(chain) == 0 {
+		return 0, false
+	}
+	i := len(chain) - 1
+	for i > 0 && ipTrusted(chain[i], trusted) {
+		if net.ParseIP(chain[i-1]) == nil {
+			return i, false
+		}
+		i--
+	}
+	return i, net.ParseIP(chain[i]) != nil
+}
+
+// clientAddr returns the client address from a forwarded chain (see
+// clientIndex), or "" if there isn't one.
+func clientAddr(chain []string, trusted []*net.IPNet) string {
+	i, ok := clientIndex(chain, trusted)
+	if !ok {
+		return ""
+	}
+	return chain[i]
+}
+
+// publicHops returns the hops of chain without private, loopback and link
+// local addresses, which mean nothing upstream. Hops that aren't addresses
+// (eg. "unknown") are kept.
+func publicHops(chain []string) []string {
+	var hops []string
+	for _, hop := range chain {
+		ip := net.ParseIP(hop)
+		if ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+			continue
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+func ipTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
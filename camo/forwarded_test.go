@@ -0,0 +1,121 @@
+package camo
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardedChain(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		chain      []string
+	}{
+		{"direct", "203.0.113.1:1234", nil, []string{"203.0.113.1"}},
+		{"kept and appended", "10.0.0.1:1234", []string{"198.51.100.1, 192.0.2.1"}, []string{"198.51.100.1", "192.0.2.1", "10.0.0.1"}},
+		{"several headers", "10.0.0.1:1234", []string{"198.51.100.1", "192.0.2.1,10.0.0.2"}, []string{"198.51.100.1", "192.0.2.1", "10.0.0.2", "10.0.0.1"}},
+		{"ipv6", "[2001:db8::1]:1234", []string{"2001:db8:1::1"}, []string{"2001:db8:1::1", "2001:db8::1"}},
+		{"garbage hop", "10.0.0.1:1234", []string{"192.0.2.1, unknown"}, []string{"192.0.2.1", "unknown", "10.0.0.1"}},
+		{"unix socket peer", "@", []string{"198.51.100.1, 192.0.2.1"}, []string{"198.51.100.1", "192.0.2.1"}},
+		{"unix socket peer without header", "@", nil, nil},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		assert.Equal(t, tt.chain, forwardedChain(req), tt.name)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	t.Parallel()
+	var trusted []*net.IPNet
+	for _, v := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		_, n, _ := net.ParseCIDR(v)
+		trusted = append(trusted, n)
+	}
+
+	tests := []struct {
+		name    string
+		chain   []string
+		trusted []*net.IPNet
+		client  string
+	}{
+		{"direct", []string{"203.0.113.1"}, trusted, "203.0.113.1"},
+		{"spoofed by client", []string{"192.0.2.1", "203.0.113.1"}, trusted, "203.0.113.1"},
+		{"nothing trusted", []string{"192.0.2.1", "10.0.0.1"}, nil, "10.0.0.1"},
+		{"one proxy", []string{"192.0.2.1", "10.0.0.1"}, trusted, "192.0.2.1"},
+		{"two proxies", []string{"192.0.2.1", "10.0.0.2", "10.0.0.1"}, trusted, "192.0.2.1"},
+		{"spoofed behind proxy", []string{"198.51.100.1", "192.0.2.1", "10.0.0.1"}, trusted, "192.0.2.1"},
+		{"ipv6", []string{"2001:db8:1::1", "2001:db8::1"}, trusted, "2001:db8:1::1"},
+		{"all trusted", []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"}, trusted, "10.0.0.3"},
+		{"garbage hop", []string{"192.0.2.1", "unknown", "10.0.0.2", "10.0.0.1"}, trusted, ""},
+		{"unknown peer of proxy", []string{"unknown", "10.0.0.1"}, trusted, ""},
+		{"unix socket peer", []string{"198.51.100.1", "192.0.2.1"}, nil, "192.0.2.1"},
+		{"unix socket peer with garbage", []string{"unknown"}, trusted, ""},
+		{"empty", nil, trusted, ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.client, clientAddr(tt.chain, tt.trusted), tt.name)
+	}
+}
+
+func TestForwardedForUpstream(t *testing.T) {
+	t.Parallel()
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name     string
+		trusted  []*net.IPNet
+		disabled bool
+		xff      string
+	}{
+		{"spoofed hop dropped", []*net.IPNet{trusted}, false, "203.0.113.5"},
+		{"nothing trusted", nil, false, ""},
+		{"disabled", []*net.IPNet{trusted}, true, ""},
+	}
+
+	for _, tt := range tests {
+		config := camoConfig
+		config.TrustedProxies = tt.trusted
+		config.DisableForwardedFor = tt.disabled
+		camoServer, req, received := upstreamProxy(t, config)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.5")
+		record := httptest.NewRecorder()
+		camoServer.ServeHTTP(record, req)
+		assert.Equal(t, 200, record.Code, tt.name)
+		assert.Equal(t, tt.xff, (<-received).Get("X-Forwarded-For"), tt.name)
+	}
+}
+
+func TestPublicHops(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		chain []string
+		hops  []string
+	}{
+		{"public", []string{"192.0.2.1", "2001:db8::1"}, []string{"192.0.2.1", "2001:db8::1"}},
+		{"rfc1918", []string{"10.0.0.1", "172.16.0.1", "192.168.1.1", "192.0.2.1"}, []string{"192.0.2.1"}},
+		{"loopback", []string{"127.0.0.1", "::1", "192.0.2.1"}, []string{"192.0.2.1"}},
+		{"link local", []string{"169.254.0.1", "fe80::1", "192.0.2.1"}, []string{"192.0.2.1"}},
+		{"ipv6 ula", []string{"fc00::1", "fd12:3456::1", "2001:db8::1"}, []string{"2001:db8::1"}},
+		{"ipv4 mapped", []string{"::ffff:10.0.0.1", "::ffff:192.0.2.1"}, []string{"::ffff:192.0.2.1"}},
+		{"not an address", []string{"unknown", "10.0.0.1"}, []string{"unknown"}},
+		{"all private", []string{"10.0.0.1", "::1"}, nil},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.hops, publicHops(tt.chain), tt.name)
+	}
+}
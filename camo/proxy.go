@@ -7,15 +7,16 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/cactus/go-camo/camo/encoding"
-	"github.com/cactus/gologit"
-	httpclient "github.com/mreiferson/go-httpclient"
+	"github.com/cactus/go-camo/logging"
+	"github.com/cactus/go-camo/reqctx"
+	"github.com/cactus/go-camo/trace"
 )
 
 // Config holds configuration data used when creating a Proxy with New.
@@ -38,24 +39,114 @@ type Config struct {
 	// Keepalive enable/disable
 	DisableKeepAlivesFE bool
 	DisableKeepAlivesBE bool
+	// CacheMinTTL, if non-zero, is the minimum cache lifetime (max-age)
+	// sent to clients for image responses.
+	CacheMinTTL time.Duration
+	// CacheMaxTTL, if non-zero, is the maximum cache lifetime (max-age)
+	// sent to clients for image responses.
+	CacheMaxTTL time.Duration
+	// CacheDefaultTTL, if non-zero, is the cache lifetime used when the
+	// upstream response has neither a max-age nor an Expires header.
+	CacheDefaultTTL time.Duration
+	// CacheRewritePrivate rewrites private and no-store Cache-Control
+	// directives on image responses to public, so that shared caches (eg.
+	// a CDN) may store them.
+	CacheRewritePrivate bool
+	// FallbackImage, if set, is served as the response body (with the
+	// usual error status code) in place of a text error message when a
+	// request fails.
+	FallbackImage []byte
+	// FallbackContentType is the content type of FallbackImage. If empty,
+	// it is detected from the image data.
+	FallbackContentType string
+	// ServerTiming adds a Server-Timing header to responses, with the
+	// duration of each phase of handling the request (decode, policy, dns,
+	// connect, tls, ttfb), and a Server-Timing trailer with the duration of
+	// the body copy.
+	ServerTiming bool
+	// ForwardRequestID sends the request id (see reqctx.RequestIDHeader) to
+	// the upstream server.
+	ForwardRequestID bool
+	// TrustedProxies are the networks of proxies (eg. a load balancer or
+	// CDN) in front of the Proxy, whose X-Forwarded-For headers are
+	// believed when determining the client address. Hops left of the
+	// client are not forwarded.
+	TrustedProxies []*net.IPNet
+	// DisableForwardedFor stops sending the X-Forwarded-For chain, and the
+	// connecting address, to upstream servers.
+	DisableForwardedFor bool
 }
 
 // ProxyMetrics interface for Proxy to use for stats/metrics.
 // This must be goroutine safe, as AddBytes and AddServed will be called from
-// many goroutines.
+// many goroutines. Methods are called synchronously while handling a request,
+// so they must be cheap and must not block (eg. an atomic add).
 type ProxyMetrics interface {
 	AddBytes(bc int64)
 	AddServed()
 }
 
+// ProxyMetricsExtended is an optional interface that a ProxyMetrics
+// collector may also implement, in order to receive more detailed data about
+// each request. Like ProxyMetrics, it must be goroutine safe.
+type ProxyMetricsExtended interface {
+	ProxyMetrics
+	// AddResponse is called with the status code of each response.
+	AddResponse(code int)
+	// AddRejected is called with the Reason of each failed request.
+	AddRejected(reason Reason)
+	// AddUpstreamLatency is called with the time taken for each upstream
+	// request to return response headers (or fail).
+	AddUpstreamLatency(d time.Duration)
+}
+
+// ProxyMetricsInFlight is an optional interface that a ProxyMetrics
+// collector may also implement, in order to track in-flight requests. Like
+// ProxyMetrics, it must be goroutine safe and cheap.
+type ProxyMetricsInFlight interface {
+	// AddInFlight is called with 1 when the Proxy starts handling a
+	// request, and with -1 when it is done.
+	AddInFlight(delta int64)
+	// AddUpstreamInFlight is called with 1 when an upstream request is
+	// started, and with -1 once its response has been fully relayed.
+	AddUpstreamInFlight(delta int64)
+}
+
+// ProxyMetricsHosts is an optional interface that a ProxyMetrics collector
+// may also implement, in order to receive per upstream host data. Like
+// ProxyMetrics, it must be goroutine safe and cheap.
+type ProxyMetricsHosts interface {
+	// AddHost is called once for each request with a valid upstream host,
+	// with the number of bytes served, and the reason the request failed
+	// (ReasonNone if it didn't).
+	AddHost(host string, bc int64, reason Reason)
+}
+
 // A Proxy is a Camo like HTTP proxy, that provides content type
 // restrictions as well as regex host allow list support.
 type Proxy struct {
-	client *http.Client
+	// replaced by Reload
+	state   atomic.Pointer[proxyState]
+	metrics ProxyMetrics
+	// set if metrics also implements ProxyMetricsExtended
+	extMetrics ProxyMetricsExtended
+	// set if metrics also implements ProxyMetricsInFlight
+	inFlight ProxyMetricsInFlight
+	// set if metrics also implements ProxyMetricsHosts
+	hostMetrics ProxyMetricsHosts
+	// optional tracer for per request spans
+	tracer *trace.Tracer
+}
+
+// proxyState holds the parts of a Proxy derived from its Config, which are
+// swapped as a whole by Reload. A request uses the proxyState current when
+// it started throughout.
+type proxyState struct {
 	config *Config
 	// compiled allow list regex
 	allowList []*regexp.Regexp
-	metrics   ProxyMetrics
+	transport *http.Transport
+	client    *http.Client
 }
 
 // ServerHTTP handles the client request, validates the request is validly
@@ -63,86 +154,86 @@ type Proxy struct {
 // valid requests to the desired endpoint. Responses are filtered for
 // proper image content types.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	gologit.Debugln("Request:", req.URL)
-	if p.metrics != nil {
-		go p.metrics.AddServed()
-	}
+	rlog := reqLogger(req)
+	rlog.Debug("request", "url", req.URL.String())
 
-	if p.config.DisableKeepAlivesFE {
-		w.Header().Set("Connection", "close")
+	st := p.state.Load()
+	c := st.config
+
+	var timer *reqTimer
+	if p.tracer != nil || c.ServerTiming {
+		req, timer = withReqTimer(req)
+	}
+	if p.tracer != nil {
+		timer.startTrace(p.tracer, req)
+		defer func() {
+			p.exportTrace(req, timer, time.Now())
+		}()
 	}
 
-	if req.Header.Get("Via") == p.config.ServerName {
-		http.Error(w, "Request loop failure", http.StatusNotFound)
-		return
+	if p.metrics != nil {
+		p.metrics.AddServed()
+	}
+	if p.inFlight != nil {
+		p.inFlight.AddInFlight(1)
+		defer p.inFlight.AddInFlight(-1)
 	}
 
-	// split path and get components
-	components := strings.Split(req.URL.Path, "/")
-	if len(components) < 3 {
-		http.Error(w, "Malformed request path", http.StatusNotFound)
-		return
+	// only the client and the trusted proxies after it are passed on
+	chain := forwardedChain(req)
+	i, ok := clientIndex(chain, c.TrustedProxies)
+	if ok {
+		reqctx.RequestInfoFromContext(req.Context()).SetClientIP(chain[i])
 	}
-	sigHash, encodedURL := components[1], components[2]
+	chain = chain[i:]
 
-	sURL, ok := encoding.DecodeURL(p.config.HMACKey, sigHash, encodedURL)
-	if !ok {
-		http.Error(w, "Bad Signature", http.StatusForbidden)
-		return
+	if c.DisableKeepAlivesFE {
+		w.Header().Set("Connection", "close")
 	}
-	gologit.Debugln("URL:", sURL)
-	gologit.Debugln("Client request:", req)
 
-	u, err := url.Parse(sURL)
-	if err != nil {
-		gologit.Debugln("url parse error:", err)
-		http.Error(w, "Bad url", http.StatusBadRequest)
+	if req.Header.Get("Via") == c.ServerName {
+		p.writeError(w, req, c, newProxyError(ReasonRequestLoop,
+			http.StatusNotFound, "Request loop failure", nil))
 		return
 	}
 
-	u.Host = strings.ToLower(u.Host)
-	if u.Host == "" || localhostRegex.MatchString(u.Host) {
-		http.Error(w, "Bad url host", http.StatusNotFound)
-		return
+	sURL, u, perr := st.checkURL(req.URL.Path, timer, nil)
+	if u != nil {
+		reqctx.RequestInfoFromContext(req.Context()).SetUpstreamHost(u.Host)
+		timer.setHost(u.Host)
 	}
 
-	// if allowList is set, require match
-	matchFound := true
-	if len(p.allowList) > 0 {
-		matchFound = false
-		for _, rgx := range p.allowList {
-			if rgx.MatchString(u.Host) {
-				matchFound = true
-			}
-		}
+	// bytes served, and why the request failed (if it did), for host metrics
+	var bW int64
+	hostReason := ReasonNone
+	if u != nil && p.hostMetrics != nil {
+		defer func() {
+			p.hostMetrics.AddHost(u.Host, bW, hostReason)
+		}()
 	}
-	if !matchFound {
-		http.Error(w, "Allowlist host failure", http.StatusNotFound)
-		return
+	fail := func(e *ProxyError) {
+		hostReason = e.Reason
+		p.writeError(w, req, c, e)
 	}
 
-	// filter out rfc1918 hosts
-	ip := net.ParseIP(u.Host)
-	if ip != nil {
-		if addr1918PrefixRegex.MatchString(ip.String()) {
-			http.Error(w, "Denylist host failure", http.StatusNotFound)
-			return
-		}
+	if perr != nil {
+		fail(perr)
+		return
 	}
+	rlog.Debug("decoded url", "url", sURL, "client_request", logging.Request(req))
 
 	nreq, err := http.NewRequest(req.Method, sURL, nil)
 	if err != nil {
-		gologit.Debugln("Could not create NewRequest", err)
-		http.Error(w, "Error Fetching Resource", http.StatusBadGateway)
+		fail(newProxyError(ReasonBadURL,
+			http.StatusBadGateway, "Error Fetching Resource", err))
 		return
 	}
 
 	// filter headers
 	p.copyHeader(&nreq.Header, &req.Header, &ValidReqHeaders)
-	if req.Header.Get("X-Forwarded-For") == "" {
-		host, _, err := net.SplitHostPort(req.RemoteAddr)
-		if err == nil && !addr1918PrefixRegex.MatchString(host) {
-			nreq.Header.Add("X-Forwarded-For", host)
+	if !c.DisableForwardedFor {
+		if hops := publicHops(chain); len(hops) > 0 {
+			nreq.Header.Set("X-Forwarded-For", strings.Join(hops, ", "))
 		}
 	}
 
@@ -151,36 +242,61 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		nreq.Header.Add("Accept", "image/*")
 	}
 
-	nreq.Header.Add("User-Agent", p.config.ServerName)
-	nreq.Header.Add("Via", p.config.ServerName)
+	nreq.Header.Add("User-Agent", c.ServerName)
+	nreq.Header.Add("Via", c.ServerName)
+	if c.ForwardRequestID {
+		if id := reqctx.RequestIDFromContext(req.Context()); id != "" {
+			nreq.Header.Set(reqctx.RequestIDHeader, id)
+		}
+	}
+	if tp := timer.upstreamTraceparent(); tp != "" {
+		nreq.Header.Set(trace.TraceparentHeader, tp)
+	}
 
-	gologit.Debugln("Built outgoing request:", nreq)
+	rlog.Debug("built outgoing request", "upstream_request", logging.Request(nreq))
+	timer.finish(phasePolicy)
 
-	resp, err := p.client.Do(nreq)
+	if p.inFlight != nil {
+		p.inFlight.AddUpstreamInFlight(1)
+		defer p.inFlight.AddUpstreamInFlight(-1)
+	}
+	if timer != nil {
+		nreq = nreq.WithContext(timer.withClientTrace(nreq.Context()))
+	}
+	timer.begin(phaseUpstream)
+	timer.begin(phaseTTFB)
+	start := time.Now()
+	resp, err := st.client.Do(nreq)
+	timer.finish(phaseTTFB)
+	timer.finish(phaseUpstream)
+	if p.extMetrics != nil {
+		p.extMetrics.AddUpstreamLatency(time.Since(start))
+	}
 	if err != nil {
-		gologit.Debugln("Could not connect to endpoint", err)
-		// this is a bit janky, but better than peeling off the
-		// 3 layers of wrapped errors and trying to get to net.OpErr and
-		// still having to rely on string comparison to find out if it is
-		// a net.errClosing or not.
-		errString := err.Error()
-		if strings.Contains(errString, "timeout") {
-			http.Error(w, "Error Fetching Resource", http.StatusGatewayTimeout)
-		} else if strings.Contains(errString, "use of closed") {
-			http.Error(w, "Error Fetching Resource", http.StatusBadGateway)
-		} else {
+		reason := classifyUpstreamError(err)
+		code := http.StatusNotFound
+		switch reason {
+		case ReasonUpstreamTimeout:
+			code = http.StatusGatewayTimeout
+		case ReasonUpstreamClosed:
+			code = http.StatusBadGateway
+		default:
 			// some other error. call it a not found (camo compliant)
-			http.Error(w, "Error Fetching Resource", http.StatusNotFound)
 		}
+		fail(newProxyError(reason, code, "Error Fetching Resource", err))
 		return
 	}
 	defer resp.Body.Close()
-	gologit.Debugln("Response from upstream:", resp)
+	reqctx.RequestInfoFromContext(req.Context()).SetUpstreamStatus(resp.StatusCode)
+	timer.setUpstreamStatus(resp.StatusCode)
+	rlog.Debug("response from upstream", "upstream_response", logging.Response(resp))
 
 	// check for too large a response
-	if resp.ContentLength > p.config.MaxSize {
-		gologit.Debugln("Content length exceeded", sURL)
-		http.Error(w, "Content length exceeded", http.StatusNotFound)
+	if resp.ContentLength > c.MaxSize {
+		rlog.Debug("content length exceeded", "url", sURL,
+			"content_length", resp.ContentLength)
+		fail(newProxyError(ReasonTooLarge,
+			http.StatusNotFound, "Content length exceeded", nil))
 		return
 	}
 
@@ -188,68 +304,123 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	case 200:
 		// check content type
 		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
-			gologit.Debugln("Non-Image content-type returned", u)
-			http.Error(w, "Non-Image content-type returned",
-				http.StatusBadRequest)
+			rlog.Debug("non-image content-type returned", "url", sURL,
+				"content_type", resp.Header.Get("Content-Type"))
+			fail(newProxyError(ReasonBadContentType,
+				http.StatusBadRequest, "Non-Image content-type returned", nil))
 			return
 		}
 	case 300:
-		gologit.Debugln("Multiple choices not supported")
-		http.Error(w, "Multiple choices not supported", http.StatusNotFound)
+		rlog.Debug("multiple choices not supported", "url", sURL)
+		fail(newProxyError(ReasonUpstreamStatus,
+			http.StatusNotFound, "Multiple choices not supported", nil))
 		return
 	case 301, 302, 303, 307:
 		// if we get a redirect here, we either disabled following,
 		// or followed until max depth and still got one (redirect loop)
-		http.Error(w, "Not Found", http.StatusNotFound)
+		fail(newProxyError(ReasonTooManyRedirects,
+			http.StatusNotFound, "Not Found", nil))
 		return
 	case 304:
 		h := w.Header()
 		p.copyHeader(&h, &resp.Header, &ValidRespHeaders)
+		c.applyCachePolicy(h, time.Now())
+		c.setServerTiming(h, timer)
 		w.WriteHeader(304)
+		p.addResponse(304)
+		timer.setResult(304, ReasonNone)
 		return
 	case 404:
-		http.Error(w, "Not Found", http.StatusNotFound)
+		fail(newProxyError(ReasonUpstreamStatus, http.StatusNotFound, "Not Found", nil))
 		return
 	case 500, 502, 503, 504:
 		// upstream errors should probably just 502. client can try later.
-		http.Error(w, "Error Fetching Resource", http.StatusBadGateway)
+		fail(newProxyError(ReasonUpstreamStatus,
+			http.StatusBadGateway, "Error Fetching Resource", nil))
 		return
 	default:
-		http.Error(w, "Not Found", http.StatusNotFound)
+		fail(newProxyError(ReasonUpstreamStatus, http.StatusNotFound, "Not Found", nil))
 		return
 	}
 
 	h := w.Header()
 	p.copyHeader(&h, &resp.Header, &ValidRespHeaders)
+	c.applyCachePolicy(h, time.Now())
+	c.setServerTiming(h, timer)
 	w.WriteHeader(resp.StatusCode)
+	p.addResponse(resp.StatusCode)
 
 	// since this uses io.Copy from the respBody, it is streaming
 	// from the request to the response. This means it will nearly
 	// always end up with a chunked response.
-	bW, err := io.Copy(w, resp.Body)
+	timer.setResult(resp.StatusCode, ReasonNone)
+	timer.begin(phaseCopy)
+	bW, err = io.Copy(w, resp.Body)
+	timer.finish(phaseCopy)
+	c.setServerTimingTrailer(h, timer)
 	if err != nil {
-		if opErr, ok := err.(*net.OpError); ok {
-			switch opErr.Err {
-			case syscall.EPIPE, syscall.ECONNRESET:
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
 				// broken pipe - endpoint terminated the conn
 				// connection reset by peer - endpoint terminated the conn
 				// log as debug only.
-				gologit.Debugln("OpError writing response:", err)
-			default:
+				rlog.Debug("error writing response", "error", err)
+			} else {
 				// log anything else normally
-				gologit.Println("OpError writing response:", err)
+				rlog.Warn("error writing response", "error", err)
 			}
 		} else {
 			// unknown error and not an OpError.
-			gologit.Println("Error writing response:", err)
+			rlog.Warn("error writing response", "error", err)
 		}
+		hostReason = classifyUpstreamError(err)
 		return
 	}
 
 	if p.metrics != nil {
-		go p.metrics.AddBytes(bW)
+		p.metrics.AddBytes(bW)
+	}
+	rlog.Debug("response sent", "status", resp.StatusCode, "bytes", bW)
+}
+
+// writeError replies to the request with the status code of e, and the
+// machine readable reason in the X-Camo-Error header. If a fallback image is
+// configured it is used as the response body, otherwise the error message is
+// sent as plain text.
+func (p *Proxy) writeError(w http.ResponseWriter, req *http.Request, c *Config, e *ProxyError) {
+	reqLogger(req).Debug("request failed", "reason", e.Reason.String(),
+		"status", e.Code, "error", e.Error())
+	reqctx.RequestInfoFromContext(req.Context()).SetReason(e.Reason.String())
+	timer := reqTimerFromContext(req.Context())
+	timer.setResult(e.Code, e.Reason)
+	if p.extMetrics != nil {
+		p.extMetrics.AddRejected(e.Reason)
+	}
+	p.addResponse(e.Code)
+	h := w.Header()
+	h.Set(errorHeader, e.Reason.String())
+	c.setServerTiming(h, timer)
+	if len(c.FallbackImage) == 0 {
+		http.Error(w, e.Msg, e.Code)
+		return
+	}
+	h.Set("Content-Type", c.FallbackContentType)
+	h.Set("Content-Length", strconv.Itoa(len(c.FallbackImage)))
+	// the url may work later, so don't let caches keep the fallback for it
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(e.Code)
+	if req.Method != "HEAD" {
+		w.Write(c.FallbackImage)
+	}
+}
+
+// addResponse records the response status code with the metrics collector,
+// if it is a ProxyMetricsExtended.
+func (p *Proxy) addResponse(code int) {
+	if p.extMetrics != nil {
+		p.extMetrics.AddResponse(code)
 	}
-	gologit.Debugln("Response to client:", w)
 }
 
 // copy headers from src into dst
@@ -272,41 +443,48 @@ func (p *Proxy) copyHeader(dst, src *http.Header, filter *map[string]bool) {
 }
 
 // SetMetricsCollector sets a proxy metrics (ProxyMetrics interface) for
-// the proxy
+// the proxy. If pm also implements ProxyMetricsExtended, the extended
+// metrics are reported as well, and likewise for ProxyMetricsInFlight and
+// ProxyMetricsHosts.
 func (p *Proxy) SetMetricsCollector(pm ProxyMetrics) {
 	p.metrics = pm
+	p.extMetrics, _ = pm.(ProxyMetricsExtended)
+	p.inFlight, _ = pm.(ProxyMetricsInFlight)
+	p.hostMetrics, _ = pm.(ProxyMetricsHosts)
 }
 
-// New returns a new Proxy. An error is returned if there was a failure
-// to parse the regex from the passed Config.
-func New(pc Config) (*Proxy, error) {
-	tr := &httpclient.Transport{
-		MaxIdleConnsPerHost: 8,
-		ConnectTimeout:      2 * time.Second,
-		RequestTimeout:      pc.RequestTimeout,
-		DisableKeepAlives:   pc.DisableKeepAlivesBE,
-		// no need for compression with images
-		// some xml/svg can be compressed, but apparently some clients can
-		// exhibit weird behavior when those are compressed
-		DisableCompression:  true,
-	}
+// SetTracer sets a tracer for the proxy. Each request is then recorded as a
+// span, with child spans for signature decoding, policy checks, the upstream
+// fetch (and its dns, connect, tls and time to first byte phases), and the
+// body copy.
+func (p *Proxy) SetTracer(t *trace.Tracer) {
+	p.tracer = t
+}
 
-	// spawn an idle conn trimmer
-	go func() {
-		// prunes every 5 minutes. this is just a guess at an
-		// initial value. very busy severs may want to lower this...
-		for {
-			time.Sleep(5 * time.Minute)
-			tr.CloseIdleConnections()
-		}
-	}()
+// Reload replaces the Config of a running Proxy. Requests in progress finish
+// with the previous Config. If pc is invalid, an error is returned and the
+// previous Config is kept.
+func (p *Proxy) Reload(pc Config) error {
+	prev := p.state.Load()
+	st, err := newProxyState(pc, prev)
+	if err != nil {
+		return err
+	}
+	p.state.Store(st)
+	if st.transport != prev.transport {
+		// requests in progress with the previous transport finish within
+		// its request timeout, after which its connections can be closed
+		time.AfterFunc(prev.config.RequestTimeout, prev.transport.CloseIdleConnections)
+	}
+	return nil
+}
 
-	client := &http.Client{Transport: tr}
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		if len(via) >= pc.MaxRedirects {
-			return errors.New("Too many redirects")
-		}
-		return nil
+// newProxyState validates pc, and returns a proxyState built from it. The
+// upstream transport of prev (if not nil) is reused if its settings are
+// unchanged, to keep its idle connections.
+func newProxyState(pc Config, prev *proxyState) (*proxyState, error) {
+	if pc.CacheMinTTL > 0 && pc.CacheMaxTTL > 0 && pc.CacheMinTTL > pc.CacheMaxTTL {
+		return nil, errors.New("CacheMinTTL must not be greater than CacheMaxTTL")
 	}
 
 	var allow []*regexp.Regexp
@@ -321,8 +499,64 @@ func New(pc Config) (*Proxy, error) {
 		allow = append(allow, c)
 	}
 
-	return &Proxy{
-		client:    client,
+	if len(pc.FallbackImage) > 0 && pc.FallbackContentType == "" {
+		pc.FallbackContentType = http.DetectContentType(pc.FallbackImage)
+	}
+
+	var tr *http.Transport
+	if prev != nil && prev.config.DisableKeepAlivesBE == pc.DisableKeepAlivesBE {
+		tr = prev.transport
+	} else {
+		// dialing with the request context lets the httptrace hooks see the
+		// dns lookup and connect
+		dialer := &net.Dialer{Timeout: 2 * time.Second}
+		tr = &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: 8,
+			DisableKeepAlives:   pc.DisableKeepAlivesBE,
+			// no need for compression with images
+			// some xml/svg can be compressed, but apparently some clients can
+			// exhibit weird behavior when those are compressed
+			DisableCompression: true,
+		}
+	}
+
+	// the timeout covers the whole upstream request, including reading the
+	// body
+	client := &http.Client{Transport: tr, Timeout: pc.RequestTimeout}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= pc.MaxRedirects {
+			return errTooManyRedirects
+		}
+		return nil
+	}
+
+	return &proxyState{
 		config:    &pc,
-		allowList: allow}, nil
+		allowList: allow,
+		transport: tr,
+		client:    client}, nil
+}
+
+// New returns a new Proxy. An error is returned if there was a failure
+// to parse the regex from the passed Config.
+func New(pc Config) (*Proxy, error) {
+	st, err := newProxyState(pc, nil)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{}
+	p.state.Store(st)
+
+	// spawn an idle conn trimmer
+	go func() {
+		// prunes every 5 minutes. this is just a guess at an
+		// initial value. very busy severs may want to lower this...
+		for {
+			time.Sleep(5 * time.Minute)
+			p.state.Load().transport.CloseIdleConnections()
+		}
+	}()
+
+	return p, nil
 }
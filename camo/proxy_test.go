@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/cactus/go-camo/camo/encoding"
+	"github.com/cactus/go-camo/reqctx"
 	"github.com/cactus/go-camo/router"
 	"github.com/stretchr/testify/assert"
 )
@@ -32,14 +34,25 @@ func makeReq(testURL string) (*http.Request, error) {
 }
 
 func processRequest(req *http.Request, status int) (*httptest.ResponseRecorder, error) {
-	camoServer, err := New(camoConfig)
+	return processConfigRequest(camoConfig, req, status)
+}
+
+func processConfigRequest(config Config, req *http.Request, status int) (*httptest.ResponseRecorder, error) {
+	return processMetricsRequest(config, nil, req, status)
+}
+
+func processMetricsRequest(config Config, pm ProxyMetrics, req *http.Request, status int) (*httptest.ResponseRecorder, error) {
+	camoServer, err := New(config)
 	if err != nil {
 		return nil, fmt.Errorf("Error building Camo: %s", err.Error())
 	}
+	if pm != nil {
+		camoServer.SetMetricsCollector(pm)
+	}
 
 	router := &router.DumbRouter{
 	    AddHeaders:      map[string]string{"X-Go-Camo": "test"},
-		ServerName:      camoConfig.ServerName,
+		ServerName:      config.ServerName,
 		CamoHandler:     camoServer,
 	}
 
@@ -217,3 +230,126 @@ func TestSupplyAcceptIfNoneGiven(t *testing.T) {
 	_, err = processRequest(req, 200)
 	assert.Nil(t, err)
 }
+
+func TestErrorReasonHeader(t *testing.T) {
+	t.Parallel()
+	req, err := http.NewRequest("GET", "http://example.com/deadbeef/deadbeef", nil)
+	assert.Nil(t, err)
+
+	record, err := processRequest(req, 403)
+	assert.Nil(t, err)
+	assert.Equal(t, record.HeaderMap.Get("X-Camo-Error"), "bad-signature", "Expected reason header not found")
+	assert.Equal(t, record.Body.String(), "Bad Signature\n", "Expected text error body but got '%s' instead", record.Body.String())
+}
+
+func TestFallbackImage(t *testing.T) {
+	t.Parallel()
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+	config := camoConfig
+	config.FallbackImage = gif
+
+	req, err := http.NewRequest("GET", "http://example.com/deadbeef/deadbeef", nil)
+	assert.Nil(t, err)
+	record, err := processConfigRequest(config, req, 403)
+	assert.Nil(t, err)
+	assert.Equal(t, record.HeaderMap.Get("Content-Type"), "image/gif", "Expected fallback content type")
+	assert.Equal(t, record.HeaderMap.Get("X-Camo-Error"), "bad-signature", "Expected reason header not found")
+	assert.Equal(t, record.Body.Bytes(), gif, "Expected fallback image body")
+	assert.Equal(t, "no-store", record.HeaderMap.Get("Cache-Control"))
+
+	req, err = http.NewRequest("HEAD", "http://example.com/deadbeef/deadbeef", nil)
+	assert.Nil(t, err)
+	record, err = processConfigRequest(config, req, 403)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/gif", record.HeaderMap.Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(len(gif)), record.HeaderMap.Get("Content-Length"))
+	assert.Equal(t, 0, record.Body.Len(), "Expected no body for HEAD")
+
+	req, err = makeReq("http://10.0.0.1/foo.cgi")
+	assert.Nil(t, err)
+	record, err = processConfigRequest(config, req, 404)
+	assert.Nil(t, err)
+	assert.Equal(t, record.HeaderMap.Get("X-Camo-Error"), "deny-list", "Expected reason header not found")
+	assert.Equal(t, record.Body.Bytes(), gif, "Expected fallback image body")
+}
+
+type hostRecorder struct {
+	hosts   []string
+	reasons []Reason
+}
+
+func (hr *hostRecorder) AddServed()        {}
+func (hr *hostRecorder) AddBytes(bc int64) {}
+func (hr *hostRecorder) AddHost(host string, bc int64, reason Reason) {
+	hr.hosts = append(hr.hosts, host)
+	hr.reasons = append(hr.reasons, reason)
+}
+
+func TestHostMetrics(t *testing.T) {
+	t.Parallel()
+	hr := &hostRecorder{}
+
+	req, err := makeReq("http://10.0.0.1/foo.cgi")
+	assert.Nil(t, err)
+	_, err = processMetricsRequest(camoConfig, hr, req, 404)
+	assert.Nil(t, err)
+
+	// no valid host, not recorded
+	req, err = http.NewRequest("GET", "http://example.com/deadbeef/deadbeef", nil)
+	assert.Nil(t, err)
+	_, err = processMetricsRequest(camoConfig, hr, req, 403)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"10.0.0.1"}, hr.hosts)
+	assert.Equal(t, []Reason{ReasonDenyList}, hr.reasons)
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	t.Parallel()
+	req, err := makeReq("http://10.0.0.1/foo.cgi")
+	assert.Nil(t, err)
+	req.Header.Set(reqctx.RequestIDHeader, "abc-123")
+	record, err := processRequest(req, 404)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc-123", record.Header().Get(reqctx.RequestIDHeader))
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+	config := camoConfig
+	config.AllowList = []string{`^8\.8\.4\.4$`}
+	camoServer, err := New(config)
+	assert.Nil(t, err)
+	path := encoding.B64EncodeURL(config.HMACKey, "http://8.8.8.8/foo.png")
+
+	ex := camoServer.Explain(path)
+	assert.Equal(t, "allow-list", ex.Reason)
+
+	config.AllowList = []string{`^8\.8\.8\.8$`}
+	assert.Nil(t, camoServer.Reload(config))
+	ex = camoServer.Explain(path)
+	assert.True(t, ex.Allowed)
+
+	// a bad allow list keeps the previous config
+	badConfig := config
+	badConfig.AllowList = []string{`(`}
+	assert.NotNil(t, camoServer.Reload(badConfig))
+	ex = camoServer.Explain(path)
+	assert.True(t, ex.Allowed)
+
+	// as does an inverted cache ttl range
+	badConfig = config
+	badConfig.CacheMinTTL = time.Hour
+	badConfig.CacheMaxTTL = time.Minute
+	assert.NotNil(t, camoServer.Reload(badConfig))
+	_, err = New(badConfig)
+	assert.NotNil(t, err)
+
+	// urls signed with the old key no longer validate
+	config.HMACKey = []byte("newkey")
+	assert.Nil(t, camoServer.Reload(config))
+	ex = camoServer.Explain(path)
+	assert.Equal(t, "bad-signature", ex.Reason)
+	ex = camoServer.Explain(encoding.B64EncodeURL(config.HMACKey, "http://8.8.8.8/foo.png"))
+	assert.True(t, ex.Allowed)
+}
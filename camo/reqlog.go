@@ -0,0 +1,18 @@
+package camo
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/cactus/go-camo/reqctx"
+)
+
+// reqLogger returns the default logger, with the request id (if any) added
+// to each line, so that the lines logged for a single request can be
+// correlated.
+func reqLogger(req *http.Request) *slog.Logger {
+	if id := reqctx.RequestIDFromContext(req.Context()); id != "" {
+		return slog.With("request_id", id)
+	}
+	return slog.Default()
+}
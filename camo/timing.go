@@ -0,0 +1,288 @@
+package camo
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cactus/go-camo/reqctx"
+	"github.com/cactus/go-camo/trace"
+)
+
+// phase is a timed part of handling a request
+type phase int
+
+const (
+	phaseDecode phase = iota
+	phasePolicy
+	phaseUpstream
+	phaseDNS
+	phaseConnect
+	phaseTLS
+	phaseTTFB
+	phaseCopy
+	numPhases
+)
+
+var phaseNames = [numPhases]string{
+	phaseDecode:   "decode",
+	phasePolicy:   "policy",
+	phaseUpstream: "upstream",
+	phaseDNS:      "dns",
+	phaseConnect:  "connect",
+	phaseTLS:      "tls",
+	phaseTTFB:     "ttfb",
+	phaseCopy:     "copy",
+}
+
+type phaseTime struct {
+	start, end time.Time
+}
+
+// reqTimer records when each phase of handling a request started and ended.
+// Only the first occurrence of a phase is kept, so for redirected requests
+// the connection phases are those of the first hop. It is goroutine safe, as
+// httptrace hooks may be called from the transport's dialing goroutines. A
+// nil *reqTimer records nothing.
+type reqTimer struct {
+	start time.Time
+
+	mu             sync.Mutex
+	phases         [numPhases]phaseTime
+	host           string
+	code           int
+	upstreamStatus int
+	reason         Reason
+
+	// set by startTrace. upstream is created before the upstream request,
+	// so that its context can be sent in a traceparent header.
+	remote   trace.SpanContext
+	root     *trace.Span
+	upstream *trace.Span
+}
+
+type reqTimerKey struct{}
+
+// withReqTimer returns a shallow copy of req with a new reqTimer, started
+// now, attached to its context.
+func withReqTimer(req *http.Request) (*http.Request, *reqTimer) {
+	t := &reqTimer{start: time.Now()}
+	return req.WithContext(context.WithValue(req.Context(), reqTimerKey{}, t)), t
+}
+
+// reqTimerFromContext returns the reqTimer attached to ctx, or nil.
+func reqTimerFromContext(ctx context.Context) *reqTimer {
+	t, _ := ctx.Value(reqTimerKey{}).(*reqTimer)
+	return t
+}
+
+func (t *reqTimer) begin(ph phase) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.phases[ph].start.IsZero() {
+		t.phases[ph].start = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+func (t *reqTimer) finish(ph phase) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if !t.phases[ph].start.IsZero() && t.phases[ph].end.IsZero() {
+		t.phases[ph].end = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+// setResult records the status code sent to the client, and the failure
+// reason (if any).
+func (t *reqTimer) setResult(code int, reason Reason) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.code = code
+	t.reason = reason
+	t.mu.Unlock()
+}
+
+func (t *reqTimer) setHost(host string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.host = host
+	t.mu.Unlock()
+}
+
+func (t *reqTimer) setUpstreamStatus(code int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.upstreamStatus = code
+	t.mu.Unlock()
+}
+
+// withClientTrace returns ctx with an httptrace.ClientTrace that records the
+// upstream connection phases.
+func (t *reqTimer) withClientTrace(ctx context.Context) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.begin(phaseDNS) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.finish(phaseDNS) },
+		ConnectStart:         func(string, string) { t.begin(phaseConnect) },
+		ConnectDone:          func(string, string, error) { t.finish(phaseConnect) },
+		TLSHandshakeStart:    func() { t.begin(phaseTLS) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.finish(phaseTLS) },
+		GotFirstResponseByte: func() { t.finish(phaseTTFB) },
+	})
+}
+
+// serverTimingHeader is the header used to report phase durations to the
+// client
+const serverTimingHeader = "Server-Timing"
+
+func serverTimingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
+
+// serverTiming returns a Server-Timing header value with the duration of
+// each phase, and the total time from the start of the request to now.
+// Phases that have not finished (eg. the request failed mid phase) end now.
+// There is no cache lookup entry, as go-camo has no cache.
+func (t *reqTimer) serverTiming(now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	metrics := make([]string, 0, numPhases+1)
+	for ph := phase(0); ph < numPhases; ph++ {
+		pt := t.phases[ph]
+		if pt.start.IsZero() {
+			continue
+		}
+		if pt.end.IsZero() {
+			pt.end = now
+		}
+		metrics = append(metrics, serverTimingMetric(phaseNames[ph], pt.end.Sub(pt.start)))
+	}
+	metrics = append(metrics, serverTimingMetric("total", now.Sub(t.start)))
+	return strings.Join(metrics, ", ")
+}
+
+// setServerTiming sets the Server-Timing header from t, if enabled. It must
+// be called before the response header is written.
+func (c *Config) setServerTiming(h http.Header, t *reqTimer) {
+	if c.ServerTiming && t != nil {
+		h.Set(serverTimingHeader, t.serverTiming(time.Now()))
+	}
+}
+
+// setServerTimingTrailer sends the duration of the body copy, which is only
+// known once the response header has been written, as a Server-Timing
+// trailer. Trailers are only sent with chunked (or http/2) responses.
+func (c *Config) setServerTimingTrailer(h http.Header, t *reqTimer) {
+	if !c.ServerTiming || t == nil {
+		return
+	}
+	t.mu.Lock()
+	pt := t.phases[phaseCopy]
+	t.mu.Unlock()
+	if pt.start.IsZero() || pt.end.IsZero() {
+		return
+	}
+	h.Set(http.TrailerPrefix+serverTimingHeader,
+		serverTimingMetric(phaseNames[phaseCopy], pt.end.Sub(pt.start)))
+}
+
+// startTrace starts the server span for the whole request, continuing the
+// trace from the incoming traceparent header of req, if there is one, along
+// with the (not yet started) upstream span.
+func (t *reqTimer) startTrace(tr *trace.Tracer, req *http.Request) {
+	t.remote, _ = trace.ParseTraceparent(req.Header.Get(trace.TraceparentHeader))
+	t.root = tr.Start("camo.request", trace.KindServer, t.remote, t.start)
+	t.upstream = t.root.Child(phaseNames[phaseUpstream], trace.KindClient, time.Time{})
+}
+
+// upstreamTraceparent returns the traceparent header value to send to the
+// upstream server, or "" if there is no trace. If the caller's trace isn't
+// sampled, its traceparent is passed on, so the decision is kept.
+func (t *reqTimer) upstreamTraceparent() string {
+	switch {
+	case t == nil:
+		return ""
+	case t.upstream != nil:
+		return t.upstream.Context.Traceparent()
+	case t.remote.IsValid():
+		return t.remote.Traceparent()
+	}
+	return ""
+}
+
+// exportTrace records the phases in t as spans, under the server span
+// started by startTrace.
+func (p *Proxy) exportTrace(req *http.Request, t *reqTimer, end time.Time) {
+	root := t.root
+	if root == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	root.SetAttr("http.method", req.Method)
+	root.SetAttr("http.status_code", t.code)
+	if t.host != "" {
+		root.SetAttr("camo.upstream_host", t.host)
+	}
+	if id := reqctx.RequestIDFromContext(req.Context()); id != "" {
+		root.SetAttr("camo.request_id", id)
+	}
+	if t.reason != ReasonNone {
+		root.SetAttr("camo.reason", t.reason.String())
+		root.SetError(t.reason.String())
+	}
+
+	var upstream *trace.Span
+	for ph := phase(0); ph < numPhases; ph++ {
+		pt := t.phases[ph]
+		if pt.start.IsZero() {
+			continue
+		}
+		if pt.end.IsZero() {
+			// eg. the request failed mid phase
+			pt.end = end
+		}
+		var s *trace.Span
+		switch ph {
+		case phaseUpstream:
+			// its id was already sent upstream, see upstreamTraceparent
+			s = t.upstream
+			s.Start = pt.start
+			upstream = s
+			if t.upstreamStatus != 0 {
+				s.SetAttr("http.status_code", t.upstreamStatus)
+			}
+		case phaseDNS, phaseConnect, phaseTLS, phaseTTFB:
+			parent := root
+			if upstream != nil {
+				parent = upstream
+			}
+			s = parent.Child(phaseNames[ph], trace.KindInternal, pt.start)
+		default:
+			s = root.Child(phaseNames[ph], trace.KindInternal, pt.start)
+		}
+		s.Finish(pt.end)
+	}
+	root.Finish(end)
+}
@@ -0,0 +1,217 @@
+package camo
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/router"
+	"github.com/cactus/go-camo/trace"
+	"github.com/stretchr/testify/assert"
+)
+
+type spanRecorder struct {
+	spans []*trace.Span
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.Span) {
+	r.spans = append(r.spans, s)
+}
+
+// upstreamProxy returns a Proxy built from config, and a signed request for
+// an image on a local TLS server, reached by the host name example.com (so
+// it isn't deny listed), which the Proxy resolves to localhost. The headers
+// of each request the server receives are sent on the returned channel.
+func upstreamProxy(t *testing.T, config Config) (*Proxy, *http.Request, chan http.Header) {
+	received := make(chan http.Header, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case received <- r.Header.Clone():
+		default:
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"))
+	}))
+	t.Cleanup(ts.Close)
+
+	p, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	tr := p.state.Load().transport
+	dialer := &net.Dialer{}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, net.JoinHostPort("localhost", port))
+	}
+	// the test server's certificate is valid for example.com
+	tr.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+	req, err := makeReq("https://example.com/image.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, req, received
+}
+
+func TestTraceSpans(t *testing.T) {
+	t.Parallel()
+	camoServer, err := New(camoConfig)
+	assert.Nil(t, err)
+	sr := &spanRecorder{}
+	camoServer.SetTracer(trace.NewTracer(sr, 1))
+	dr := &router.DumbRouter{ServerName: "go-camo", CamoHandler: camoServer}
+
+	req, err := makeReq("http://10.0.0.1/foo.cgi")
+	assert.Nil(t, err)
+	req.Header.Set(trace.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, 404, record.Code)
+
+	assert.Equal(t, 3, len(sr.spans))
+	root := sr.spans[len(sr.spans)-1]
+	assert.Equal(t, "camo.request", root.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.Context.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", root.Parent.String())
+	assert.True(t, root.Failed)
+	assert.Equal(t, "deny-list", root.StatusMsg)
+	assert.Contains(t, root.Attrs, trace.Attr{Key: "http.status_code", Value: 404})
+	assert.Contains(t, root.Attrs, trace.Attr{Key: "camo.upstream_host", Value: "10.0.0.1"})
+
+	assert.Equal(t, "decode", sr.spans[0].Name)
+	assert.Equal(t, "policy", sr.spans[1].Name)
+	for _, s := range sr.spans[:2] {
+		assert.Equal(t, root.Context.SpanID, s.Parent)
+		assert.False(t, s.End.Before(s.Start))
+	}
+
+	// not sampled by the caller, so not recorded
+	sr.spans = nil
+	req, err = makeReq("http://10.0.0.1/foo.cgi")
+	assert.Nil(t, err)
+	req.Header.Set(trace.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	dr.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 0, len(sr.spans))
+}
+
+func TestTraceSpansUpstream(t *testing.T) {
+	t.Parallel()
+	camoServer, req, _ := upstreamProxy(t, camoConfig)
+	sr := &spanRecorder{}
+	camoServer.SetTracer(trace.NewTracer(sr, 1))
+	dr := &router.DumbRouter{ServerName: "go-camo", CamoHandler: camoServer}
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, 200, record.Code)
+
+	spans := map[string]*trace.Span{}
+	for _, s := range sr.spans {
+		spans[s.Name] = s
+		assert.False(t, s.End.Before(s.Start), s.Name)
+	}
+	root, upstream := spans["camo.request"], spans["upstream"]
+	if !assert.NotNil(t, root) || !assert.NotNil(t, upstream) {
+		return
+	}
+	assert.False(t, root.Failed)
+	assert.Equal(t, trace.KindClient, upstream.Kind)
+	assert.Equal(t, root.Context.SpanID, upstream.Parent)
+	assert.Contains(t, upstream.Attrs, trace.Attr{Key: "http.status_code", Value: 200})
+	for _, name := range []string{"dns", "connect", "tls", "ttfb"} {
+		if assert.NotNil(t, spans[name], name) {
+			assert.Equal(t, upstream.Context.SpanID, spans[name].Parent, name)
+		}
+	}
+	for _, name := range []string{"decode", "policy", "copy"} {
+		if assert.NotNil(t, spans[name], name) {
+			assert.Equal(t, root.Context.SpanID, spans[name].Parent, name)
+		}
+	}
+}
+
+func TestTraceparentUpstream(t *testing.T) {
+	t.Parallel()
+	camoServer, req, received := upstreamProxy(t, camoConfig)
+	sr := &spanRecorder{}
+	camoServer.SetTracer(trace.NewTracer(sr, 1))
+	dr := &router.DumbRouter{ServerName: "go-camo", CamoHandler: camoServer}
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, 200, record.Code)
+
+	header := <-received
+	for _, s := range sr.spans {
+		if s.Name == "upstream" {
+			assert.Equal(t, s.Context.Traceparent(), header.Get(trace.TraceparentHeader))
+			assert.True(t, strings.HasSuffix(header.Get(trace.TraceparentHeader), "-01"))
+			return
+		}
+	}
+	t.Error("no upstream span")
+}
+
+func TestTraceparentUpstreamUnsampled(t *testing.T) {
+	t.Parallel()
+	camoServer, req, received := upstreamProxy(t, camoConfig)
+	camoServer.SetTracer(trace.NewTracer(&spanRecorder{}, 0))
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"
+	req.Header.Set(trace.TraceparentHeader, parent)
+	dr := &router.DumbRouter{ServerName: "go-camo", CamoHandler: camoServer}
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, 200, record.Code)
+	assert.Equal(t, parent, (<-received).Get(trace.TraceparentHeader))
+}
+
+func TestServerTimingUpstream(t *testing.T) {
+	t.Parallel()
+	config := camoConfig
+	config.ServerTiming = true
+	camoServer, req, _ := upstreamProxy(t, config)
+	dr := &router.DumbRouter{ServerName: "go-camo", CamoHandler: camoServer}
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, 200, record.Code)
+
+	st := record.Header().Get("Server-Timing")
+	assert.Regexp(t, `^decode;dur=\d+\.\d{3}, policy;dur=\d+\.\d{3}, upstream;dur=\d+\.\d{3}, `+
+		`dns;dur=\d+\.\d{3}, connect;dur=\d+\.\d{3}, tls;dur=\d+\.\d{3}, ttfb;dur=\d+\.\d{3}, `+
+		`total;dur=\d+\.\d{3}$`, st)
+}
+
+func TestServerTiming(t *testing.T) {
+	t.Parallel()
+	config := camoConfig
+	config.ServerTiming = true
+
+	req, err := makeReq("http://10.0.0.1/foo.cgi")
+	assert.Nil(t, err)
+	record, err := processConfigRequest(config, req, 404)
+	assert.Nil(t, err)
+	st := record.Header().Get("Server-Timing")
+	assert.Regexp(t, `^decode;dur=\d+\.\d{3}, policy;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}$`, st)
+
+	// off by default
+	req, err = makeReq("http://10.0.0.1/foo.cgi")
+	assert.Nil(t, err)
+	record, err = processRequest(req, 404)
+	assert.Nil(t, err)
+	assert.Equal(t, "", record.Header().Get("Server-Timing"))
+}
+
+func TestServerTimingValue(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1400000000, 0)
+	rt := &reqTimer{start: start}
+	rt.phases[phaseDecode] = phaseTime{start, start.Add(250 * time.Microsecond)}
+	rt.phases[phaseTTFB] = phaseTime{start, start.Add(12 * time.Millisecond)}
+	// unfinished phases end now
+	rt.phases[phaseCopy] = phaseTime{start: start.Add(15 * time.Millisecond)}
+	assert.Equal(t, "decode;dur=0.250, ttfb;dur=12.000, copy;dur=5.000, total;dur=20.000",
+		rt.serverTiming(start.Add(20*time.Millisecond)))
+}
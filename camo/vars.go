@@ -17,7 +17,8 @@ var ValidReqHeaders = map[string]bool{
 	"Cache-Control":     true,
 	"If-None-Match":     true,
 	"If-Modified-Since": true,
-	"X-Forwarded-For":   true,
+	// forwarded with the connecting address appended instead
+	"X-Forwarded-For":   false,
 }
 
 // Headers that are acceptible to pass from the remote server to the
@@ -42,3 +43,7 @@ var addr1918PrefixRegex = regexp.MustCompile(`^(127\.|10\.|169\.254|192\.168|172
 
 // match for localhost
 var localhostRegex = regexp.MustCompile(`^localhost\.?(localdomain)?\.?$`)
+
+// errorHeader is the response header carrying the machine readable reason
+// for a failed request.
+const errorHeader = "X-Camo-Error"
@@ -0,0 +1,215 @@
+// Package certs loads TLS certificates from files for go-camo's TLS
+// listener, selects between them by SNI, and reloads them when the files
+// change, so certificates can be rotated without a restart.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyPair is the paths of a pem encoded certificate (chain) and its private
+// key, and optionally of a DER encoded OCSP response to staple.
+type KeyPair struct {
+	CertFile       string
+	KeyFile        string
+	OCSPStapleFile string
+}
+
+// certSet is a set of loaded certificates, indexed by the names they are
+// valid for.
+type certSet struct {
+	certs  []*tls.Certificate
+	byName map[string]*tls.Certificate
+}
+
+// Store holds the certificates loaded from a list of KeyPairs. For each TLS
+// handshake, GetCertificate selects the certificate matching the requested
+// server name (SNI), or the first one if none match.
+type Store struct {
+	pairs []KeyPair
+
+	mu  sync.RWMutex
+	set *certSet
+	// modification times of the files, when last loaded
+	modTimes map[string]time.Time
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewStore returns a new Store, with the certificates in pairs loaded. An
+// error is returned if any of them can't be loaded.
+func NewStore(pairs []KeyPair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates given")
+	}
+	s := &Store{pairs: pairs, done: make(chan struct{})}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads all the certificates. If any can't be loaded, an error is
+// returned and the previously loaded certificates are kept.
+func (s *Store) Reload() error {
+	modTimes := s.statFiles()
+	set := &certSet{byName: make(map[string]*tls.Certificate)}
+	for _, p := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load certificate %s: %s", p.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("could not parse certificate %s: %s", p.CertFile, err)
+			}
+		}
+		if p.OCSPStapleFile != "" {
+			cert.OCSPStaple, err = ioutil.ReadFile(p.OCSPStapleFile)
+			if err != nil {
+				return fmt.Errorf("could not read ocsp staple: %s", err)
+			}
+			if len(cert.OCSPStaple) == 0 {
+				return fmt.Errorf("ocsp staple %s is empty", p.OCSPStapleFile)
+			}
+		}
+		set.certs = append(set.certs, &cert)
+		for _, name := range cert.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			// the first certificate listed for a name wins
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = &cert
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.set = set
+	s.modTimes = modTimes
+	s.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the certificate for a TLS handshake, for use as
+// tls.Config.GetCertificate. The certificate is chosen by an exact match of
+// the server name, then by a wildcard match, falling back to the first
+// certificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	set := s.set
+	s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := set.byName[name]; ok {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := set.byName["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	return set.certs[0], nil
+}
+
+// statFiles returns the modification times of the certificate, key and ocsp
+// staple files. Files that can't be read are left out.
+func (s *Store) statFiles() map[string]time.Time {
+	m := make(map[string]time.Time, 3*len(s.pairs))
+	for _, p := range s.pairs {
+		for _, f := range []string{p.CertFile, p.KeyFile, p.OCSPStapleFile} {
+			if f == "" {
+				continue
+			}
+			if fi, err := os.Stat(f); err == nil {
+				m[f] = fi.ModTime()
+			}
+		}
+	}
+	return m
+}
+
+// changed reports whether any of the files have been modified since they
+// were last loaded (or a load was last attempted).
+func (s *Store) changed() bool {
+	modTimes := s.statFiles()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := len(modTimes) != len(s.modTimes)
+	for f, t := range modTimes {
+		if !t.Equal(s.modTimes[f]) {
+			changed = true
+		}
+	}
+	// so a failed load (eg. a certificate written before its key) is only
+	// retried once a file changes again
+	s.modTimes = modTimes
+	return changed
+}
+
+// reload calls Reload, and logs the outcome.
+func (s *Store) reload() {
+	if err := s.Reload(); err != nil {
+		slog.Error("could not reload certificates, keeping previous ones", "error", err)
+		return
+	}
+	slog.Info("certificates reloaded")
+}
+
+// Watch spawns a goroutine that checks the certificate, key and ocsp staple
+// files for changes every interval, and reloads them if any have changed. It
+// stops when the Store is closed.
+func (s *Store) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if s.changed() {
+					s.reload()
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// ReloadOnSignal spawns a goroutine that reloads the certificates each time
+// sig is received. Reload errors are logged, and the previously loaded
+// certificates kept.
+func (s *Store) ReloadOnSignal(sig os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig)
+	go func() {
+		for {
+			select {
+			case <-c:
+				s.reload()
+			case <-s.done:
+				signal.Stop(c)
+				return
+			}
+		}
+	}()
+}
+
+// Close stops any goroutines started by Watch or ReloadOnSignal.
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
@@ -0,0 +1,178 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeKeyPair writes a new self signed certificate for names, and its key,
+// to dir, and returns their paths.
+func writeKeyPair(t *testing.T, dir, file string, names ...string) KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := KeyPair{
+		CertFile: filepath.Join(dir, file+".pem"),
+		KeyFile:  filepath.Join(dir, file+".key"),
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(p.CertFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p.KeyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "go-camo-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func certName(t *testing.T, s *Store, serverName string) string {
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	assert.Nil(t, err)
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestGetCertificate(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	s, err := NewStore([]KeyPair{
+		writeKeyPair(t, dir, "a", "a.example.com"),
+		writeKeyPair(t, dir, "wild", "*.example.org", "example.org"),
+		writeKeyPair(t, dir, "b", "b.example.org"),
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "a.example.com", certName(t, s, "a.example.com"))
+	assert.Equal(t, "a.example.com", certName(t, s, "A.Example.com."))
+	assert.Equal(t, "b.example.org", certName(t, s, "b.example.org"))
+	assert.Equal(t, "*.example.org", certName(t, s, "c.example.org"))
+	assert.Equal(t, "*.example.org", certName(t, s, "example.org"))
+	// no match, or no sni, gets the first certificate
+	assert.Equal(t, "a.example.com", certName(t, s, "c.d.example.org"))
+	assert.Equal(t, "a.example.com", certName(t, s, ""))
+}
+
+func TestNewStoreErrors(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	_, err := NewStore(nil)
+	assert.NotNil(t, err)
+
+	a := writeKeyPair(t, dir, "a", "a.example.com")
+	b := writeKeyPair(t, dir, "b", "b.example.com")
+	_, err = NewStore([]KeyPair{{CertFile: a.CertFile, KeyFile: b.KeyFile}})
+	assert.NotNil(t, err, "mismatched key")
+	_, err = NewStore([]KeyPair{{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: a.KeyFile}})
+	assert.NotNil(t, err, "missing file")
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	p := writeKeyPair(t, dir, "a", "a.example.com")
+	s, err := NewStore([]KeyPair{p})
+	assert.Nil(t, err)
+	assert.False(t, s.changed())
+
+	// replace the certificate, with a modification time that differs
+	// regardless of filesystem timestamp granularity
+	writeKeyPair(t, dir, "a", "new.example.com")
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(p.CertFile, later, later))
+	assert.True(t, s.changed())
+	assert.False(t, s.changed())
+	assert.Nil(t, s.Reload())
+	assert.Equal(t, "new.example.com", certName(t, s, "new.example.com"))
+
+	// a bad certificate keeps the previous one
+	assert.Nil(t, ioutil.WriteFile(p.CertFile, []byte("bad"), 0600))
+	assert.NotNil(t, s.Reload())
+	assert.Equal(t, "new.example.com", certName(t, s, "new.example.com"))
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	p := writeKeyPair(t, dir, "a", "a.example.com")
+	s, err := NewStore([]KeyPair{p})
+	assert.Nil(t, err)
+	s.Watch(10 * time.Millisecond)
+	defer s.Close()
+
+	writeKeyPair(t, dir, "a", "new.example.com")
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(p.CertFile, later, later))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for certName(t, s, "") != "new.example.com" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "new.example.com", certName(t, s, ""))
+}
+
+func TestOCSPStaple(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	p := writeKeyPair(t, dir, "a", "a.example.com")
+	p.OCSPStapleFile = filepath.Join(dir, "a.ocsp")
+	assert.Nil(t, ioutil.WriteFile(p.OCSPStapleFile, []byte("staple"), 0600))
+	s, err := NewStore([]KeyPair{p})
+	assert.Nil(t, err)
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("staple"), cert.OCSPStaple)
+
+	// a new staple is picked up as a change
+	assert.Nil(t, ioutil.WriteFile(p.OCSPStapleFile, []byte("new staple"), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(p.OCSPStapleFile, later, later))
+	assert.True(t, s.changed())
+	assert.Nil(t, s.Reload())
+	cert, err = s.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new staple"), cert.OCSPStaple)
+
+	assert.Nil(t, ioutil.WriteFile(p.OCSPStapleFile, nil, 0600))
+	assert.NotNil(t, s.Reload(), "empty staple")
+	assert.Nil(t, os.Remove(p.OCSPStapleFile))
+	assert.NotNil(t, s.Reload(), "missing staple")
+}
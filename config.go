@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cactus/go-camo/camo"
+	"github.com/cactus/go-camo/certs"
+	"github.com/cactus/go-camo/listener"
+	"github.com/cactus/go-camo/router"
+	flags "github.com/jessevdk/go-flags"
+)
+
+// options that may not be set from a config file
+var configFileExcluded = map[string]bool{
+	"config":       true,
+	"check-config": true,
+	"version":      true,
+}
+
+// parseOptions parses the command line args, GOCAMO_* environment variables,
+// and the config file given by the config option (if any). Options given on
+// the command line override those in the environment, which override those
+// in the config file.
+func parseOptions(args []string) (*options, error) {
+	opts := &options{}
+	parser := flags.NewParser(opts, flags.Default)
+	if _, err := parser.ParseArgs(args); err != nil {
+		return nil, err
+	}
+	if opts.ConfigFile == "" {
+		return opts, nil
+	}
+
+	fileArgs, err := configFileArgs(parser, opts.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load config file %s: %s", opts.ConfigFile, err)
+	}
+
+	// parse again, with the config file options first so that those on the
+	// command line win.
+	opts = &options{}
+	parser = flags.NewParser(opts, flags.Default)
+	if _, err := parser.ParseArgs(append(fileArgs, args...)); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// readConfigFile reads the config file at path into a map keyed by option
+// name. The format is chosen by the file extension: .json or .toml.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".json", ".toml":
+	case ".yaml", ".yml":
+		return nil, fmt.Errorf("YAML config files are not supported, use .json or .toml")
+	default:
+		return nil, fmt.Errorf("unknown config file type '%s', use .json or .toml", ext)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if ext == ".toml" {
+		if _, err := toml.Decode(string(b), &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// configFileArgs reads the config file at path, and returns its options as
+// command line args. The file is a JSON object (or TOML table) keyed by the
+// long option names, eg. {"listen": "0.0.0.0:8080", "header": ["X-Foo: bar"]}.
+// Options already set on the command line parsed by parser, or in the
+// environment, are skipped.
+func configFileArgs(parser *flags.Parser, path string) ([]string, error) {
+	m, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, k := range keys {
+		opt := parser.FindOptionByLongName(k)
+		if opt == nil || configFileExcluded[k] {
+			return nil, fmt.Errorf("unknown option '%s'", k)
+		}
+		// options with a default value count as set, but not as set by
+		// the user. Environment variables take precedence over the file.
+		if opt.IsSet() && !opt.IsSetDefault() {
+			continue
+		}
+		if env := opt.EnvKeyWithNamespace(); env != "" {
+			if _, ok := os.LookupEnv(env); ok {
+				continue
+			}
+		}
+
+		flag := "--" + k
+		kind := opt.Field().Type.Kind()
+		switch v := m[k].(type) {
+		case bool:
+			if kind != reflect.Bool {
+				return nil, fmt.Errorf("option '%s' expects a value, not a bool", k)
+			}
+			// false is the default for all bool options
+			if v {
+				args = append(args, flag)
+			}
+		case string, json.Number, int64, float64:
+			if kind == reflect.Bool {
+				return nil, fmt.Errorf("option '%s' expects a bool", k)
+			}
+			args = append(args, fmt.Sprintf("%s=%v", flag, v))
+		case []interface{}:
+			if kind != reflect.Slice {
+				return nil, fmt.Errorf("option '%s' expects a single value, not a list", k)
+			}
+			for _, e := range v {
+				switch e.(type) {
+				case string, json.Number, int64, float64:
+					args = append(args, fmt.Sprintf("%s=%v", flag, e))
+				default:
+					return nil, fmt.Errorf("option '%s' expects a list of strings", k)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("option '%s' has an unsupported value", k)
+		}
+	}
+	return args, nil
+}
+
+// buildConfig validates opts, reading any files they refer to, and returns
+// the proxy config and extra response headers built from them.
+func buildConfig(opts *options) (camo.Config, map[string]string, error) {
+	config := camo.Config{}
+	config.HMACKey = []byte(opts.HMACKey)
+	if len(config.HMACKey) == 0 {
+		return config, nil, errors.New("HMAC key required")
+	}
+
+	if opts.BindAddress == "" && opts.BindAddressSSL == "" {
+		return config, nil, errors.New("One of bind-address or bind-ssl-address required")
+	}
+
+	if _, err := unixOptions(opts); err != nil {
+		return config, nil, err
+	}
+
+	// the report lists every proxied host, and can be reset
+	if opts.TopHosts > 0 && opts.AdminToken == "" {
+		return config, nil, errors.New("admin-token is required with top-hosts")
+	}
+
+	if opts.ReadTimeout < 0 || opts.ReadHeaderTimeout < 0 || opts.WriteTimeout < 0 || opts.IdleTimeout < 0 {
+		return config, nil, errors.New("server timeouts can't be negative")
+	}
+	// the response can't be written until the upstream request finishes
+	if opts.WriteTimeout > 0 && opts.WriteTimeout <= opts.ReqTimeout {
+		return config, nil, fmt.Errorf("write-timeout (%s) must be longer than timeout (%s)", opts.WriteTimeout, opts.ReqTimeout)
+	}
+	if opts.MaxHeaderBytes <= 0 {
+		return config, nil, errors.New("max-header-bytes must be positive")
+	}
+
+	if _, err := parseCIDRs(opts.ProxyProtocolTrust); err != nil {
+		return config, nil, fmt.Errorf("bad proxy-protocol-trusted: %s", err)
+	}
+	if opts.ProxyProtocol && len(opts.ProxyProtocolTrust) == 0 &&
+		(!isUnixAddr(opts.BindAddress) || !isUnixAddr(opts.BindAddressSSL)) {
+		return config, nil, errors.New("proxy-protocol-trusted is required with proxy-protocol, unless only listening on unix domain sockets")
+	}
+
+	if opts.BindAddressSSL != "" {
+		if len(opts.SSLKey) == 0 {
+			return config, nil, errors.New("ssl-key is required when specifying bind-ssl-address")
+		}
+		if len(opts.SSLCert) == 0 {
+			return config, nil, errors.New("ssl-cert is required when specifying bind-ssl-address")
+		}
+		if len(opts.SSLCert) != len(opts.SSLKey) {
+			return config, nil, errors.New("an ssl-key is required for each ssl-cert")
+		}
+		if len(opts.SSLOCSPStaples) > len(opts.SSLCert) {
+			return config, nil, errors.New("more ssl-ocsp-staple files than ssl-certs given")
+		}
+		if _, err := certs.NewStore(sslKeyPairs(opts)); err != nil {
+			return config, nil, err
+		}
+		if _, err := buildTLSConfig(opts); err != nil {
+			return config, nil, err
+		}
+	}
+
+	// set keepalive options
+	config.DisableKeepAlivesBE = opts.DisableKeepAlivesBE
+	config.DisableKeepAlivesFE = opts.DisableKeepAlivesFE
+
+	if opts.AllowList != "" {
+		b, err := ioutil.ReadFile(opts.AllowList)
+		if err != nil {
+			return config, nil, fmt.Errorf("could not read allow-list: %s", err)
+		}
+		config.AllowList = strings.Split(string(b), "\n")
+	}
+
+	if opts.FallbackImage != "" {
+		b, err := ioutil.ReadFile(opts.FallbackImage)
+		if err != nil {
+			return config, nil, fmt.Errorf("could not read fallback-image: %s", err)
+		}
+		ctype := mime.TypeByExtension(filepath.Ext(opts.FallbackImage))
+		if ctype == "" {
+			ctype = http.DetectContentType(b)
+		}
+		if !strings.HasPrefix(ctype, "image/") {
+			return config, nil, fmt.Errorf("fallback-image is not an image (%s)", ctype)
+		}
+		config.FallbackImage = b
+		config.FallbackContentType = ctype
+	}
+
+	config.ServerTiming = opts.ServerTiming
+	config.ForwardRequestID = opts.ForwardRequestID
+	config.DisableForwardedFor = opts.NoForwardedFor
+	trusted, err := parseCIDRs(opts.TrustedProxies)
+	if err != nil {
+		return config, nil, fmt.Errorf("bad trusted-proxy: %s", err)
+	}
+	config.TrustedProxies = trusted
+
+	addHeaders := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-XSS-Protection":        "1; mode=block",
+		"Content-Security-Policy": "default-src 'none'",
+	}
+
+	for _, v := range opts.AddHeaders {
+		s := strings.SplitN(v, ":", 2)
+		if len(s) != 2 {
+			slog.Warn("ignoring bad header", "header", v)
+			continue
+		}
+
+		s0 := strings.TrimSpace(s[0])
+		s1 := strings.TrimSpace(s[1])
+
+		if len(s0) == 0 || len(s1) == 0 {
+			slog.Warn("ignoring bad header", "header", v)
+			continue
+		}
+		addHeaders[s[0]] = s[1]
+	}
+
+	// convert from KB to Bytes
+	config.MaxSize = opts.MaxSize * 1024
+	config.RequestTimeout = opts.ReqTimeout
+	config.MaxRedirects = opts.MaxRedirects
+	config.ServerName = ServerName
+	if opts.ServerName != "" {
+		config.ServerName = opts.ServerName
+	}
+	config.CacheMinTTL = opts.CacheMinTTL
+	config.CacheMaxTTL = opts.CacheMaxTTL
+	config.CacheDefaultTTL = opts.CacheDefaultTTL
+	config.CacheRewritePrivate = opts.CacheRewritePrivate
+
+	if config.CacheMinTTL > 0 && config.CacheMaxTTL > 0 && config.CacheMinTTL > config.CacheMaxTTL {
+		return config, nil, errors.New("cache-min-ttl must not be greater than cache-max-ttl")
+	}
+
+	if opts.TraceSampleRatio < 0 || opts.TraceSampleRatio > 1 {
+		return config, nil, errors.New("trace-sample-ratio must be between 0 and 1")
+	}
+
+	switch opts.AccessLogFormat {
+	case router.LogFormatCombined, router.LogFormatJSON:
+	default:
+		return config, nil, fmt.Errorf("unknown access-log-format '%s'", opts.AccessLogFormat)
+	}
+
+	return config, addHeaders, nil
+}
+
+// sslKeyPairs pairs up the ssl-cert and ssl-key options, in the order given.
+func sslKeyPairs(opts *options) []certs.KeyPair {
+	pairs := make([]certs.KeyPair, 0, len(opts.SSLCert))
+	for i := range opts.SSLCert {
+		if i < len(opts.SSLKey) {
+			pairs = append(pairs, certs.KeyPair{CertFile: opts.SSLCert[i], KeyFile: opts.SSLKey[i]})
+		}
+		if i < len(opts.SSLOCSPStaples) && i < len(pairs) {
+			pairs[i].OCSPStapleFile = opts.SSLOCSPStaples[i]
+		}
+	}
+	return pairs
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// newServer returns an http.Server for addr, with the timeouts and header
+// size limit from opts.
+func newServer(opts *options, addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadTimeout:       opts.ReadTimeout,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+	}
+}
+
+// buildTLSConfig returns the tls.Config for the TLS listener, from the ssl
+// options. Certificates are not included.
+func buildTLSConfig(opts *options) (*tls.Config, error) {
+	tc := &tls.Config{}
+
+	v, ok := tlsVersions[opts.SSLMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown ssl-min-version '%s'", opts.SSLMinVersion)
+	}
+	tc.MinVersion = v
+
+	if len(opts.SSLCiphers) > 0 {
+		suites := make(map[string]uint16)
+		for _, cs := range tls.CipherSuites() {
+			suites[cs.Name] = cs.ID
+		}
+		for _, name := range opts.SSLCiphers {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure ssl-cipher '%s'", name)
+			}
+			tc.CipherSuites = append(tc.CipherSuites, id)
+		}
+	}
+
+	for _, name := range opts.SSLCurves {
+		id, ok := tlsCurves[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown ssl-curve '%s'", name)
+		}
+		tc.CurvePreferences = append(tc.CurvePreferences, id)
+	}
+
+	if opts.SSLClientCA != "" {
+		b, err := ioutil.ReadFile(opts.SSLClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ssl-client-ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in ssl-client-ca %s", opts.SSLClientCA)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		if opts.SSLClientOptional {
+			tc.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return tc, nil
+}
+
+// unixOptions returns the permissions to set on unix domain sockets, from
+// the socket-mode and socket-group options.
+func unixOptions(opts *options) (listener.UnixOptions, error) {
+	uo := listener.UnixOptions{Group: -1}
+	mode, err := strconv.ParseUint(opts.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return uo, fmt.Errorf("bad socket-mode '%s'", opts.SocketMode)
+	}
+	uo.Mode = os.FileMode(mode)
+
+	if opts.SocketGroup != "" {
+		gid, err := strconv.Atoi(opts.SocketGroup)
+		if err != nil {
+			g, err := user.LookupGroup(opts.SocketGroup)
+			if err != nil {
+				return uo, fmt.Errorf("bad socket-group: %s", err)
+			}
+			gid, err = strconv.Atoi(g.Gid)
+			if err != nil {
+				return uo, fmt.Errorf("bad socket-group gid '%s'", g.Gid)
+			}
+		}
+		uo.Group = gid
+	}
+	return uo, nil
+}
+
+// parseCIDRs parses networks in CIDR notation, or single addresses, which
+// are taken as a /32 (or /128 for ipv6) network.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address '%s'", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isUnixAddr reports whether a listen address is empty (not listening) or a
+// unix domain socket.
+func isUnixAddr(addr string) bool {
+	return addr == "" || strings.HasPrefix(addr, listener.UnixPrefix)
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	return writeConfigFileNamed(t, "config.json", content)
+}
+
+func writeConfigFileNamed(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "go-camo-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseOptionsConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"key": "filekey",
+		"listen": "127.0.0.1:9000",
+		"max-size": 100,
+		"timeout": "10s",
+		"stats": true,
+		"no-fk": false,
+		"header": ["X-Foo: bar", "X-Bar: baz"]
+	}`)
+
+	opts, err := parseOptions([]string{"--config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, "filekey", opts.HMACKey)
+	assert.Equal(t, "127.0.0.1:9000", opts.BindAddress)
+	assert.Equal(t, int64(100), opts.MaxSize)
+	assert.Equal(t, 10*time.Second, opts.ReqTimeout)
+	assert.True(t, opts.Stats)
+	assert.False(t, opts.DisableKeepAlivesFE)
+	assert.Equal(t, []string{"X-Foo: bar", "X-Bar: baz"}, opts.AddHeaders)
+	// unset options keep their defaults
+	assert.Equal(t, 3, opts.MaxRedirects)
+}
+
+func TestParseOptionsConfigFileTOML(t *testing.T) {
+	path := writeConfigFileNamed(t, "config.toml", `
+key = "filekey"
+listen = "127.0.0.1:9000"
+max-size = 100
+timeout = "10s"
+trace-sample-ratio = 0.5
+stats = true
+header = ["X-Foo: bar", "X-Bar: baz"]
+`)
+
+	opts, err := parseOptions([]string{"--config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, "filekey", opts.HMACKey)
+	assert.Equal(t, "127.0.0.1:9000", opts.BindAddress)
+	assert.Equal(t, int64(100), opts.MaxSize)
+	assert.Equal(t, 10*time.Second, opts.ReqTimeout)
+	assert.Equal(t, 0.5, opts.TraceSampleRatio)
+	assert.True(t, opts.Stats)
+	assert.Equal(t, []string{"X-Foo: bar", "X-Bar: baz"}, opts.AddHeaders)
+
+	for _, content := range []string{
+		`key = `,
+		`stats = "yes"`,
+		`no-such-option = 1`,
+		`[listen]`,
+	} {
+		path := writeConfigFileNamed(t, "config.toml", content)
+		_, err := parseOptions([]string{"--config", path})
+		assert.NotNil(t, err, content)
+	}
+}
+
+func TestParseOptionsConfigFileType(t *testing.T) {
+	for _, name := range []string{"config.yaml", "config.yml", "config.conf", "config"} {
+		path := writeConfigFileNamed(t, name, `{"key": "filekey"}`)
+		_, err := parseOptions([]string{"--config", path})
+		assert.NotNil(t, err, name)
+	}
+
+	path := writeConfigFileNamed(t, "config.JSON", `{"key": "filekey"}`)
+	opts, err := parseOptions([]string{"--config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, "filekey", opts.HMACKey)
+}
+
+func TestParseOptionsOverride(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"key": "filekey",
+		"max-size": 100,
+		"header": ["X-Foo: bar"]
+	}`)
+
+	opts, err := parseOptions([]string{"--config", path, "--max-size", "200", "-H", "X-Baz: qux"})
+	assert.Nil(t, err)
+	assert.Equal(t, "filekey", opts.HMACKey)
+	assert.Equal(t, int64(200), opts.MaxSize)
+	assert.Equal(t, []string{"X-Baz: qux"}, opts.AddHeaders, "list options are replaced, not merged")
+}
+
+func TestParseOptionsConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown option", `{"no-such-option": "x"}`},
+		{"excluded option", `{"config": "other.json"}`},
+		{"bool for value", `{"listen": true}`},
+		{"value for bool", `{"stats": "yes"}`},
+		{"list for value", `{"listen": ["a", "b"]}`},
+		{"bad list element", `{"header": [{"X-Foo": "bar"}]}`},
+		{"bad value", `{"max-size": "lots"}`},
+		{"not an object", `["listen"]`},
+		{"bad json", `{"listen": `},
+	}
+
+	for _, tt := range tests {
+		path := writeConfigFile(t, tt.content)
+		_, err := parseOptions([]string{"--config", path})
+		assert.NotNil(t, err, tt.name)
+	}
+
+	_, err := parseOptions([]string{"--config", "/nonexistent/config.json"})
+	assert.NotNil(t, err, "missing file")
+}
+
+func TestBuildConfig(t *testing.T) {
+	opts, err := parseOptions([]string{"-k", "test", "--no-bk", "--max-size", "10", "--server-name", "my-camo",
+		"--trusted-proxy", "10.0.0.0/8", "--no-forwarded-for"})
+	assert.Nil(t, err)
+	config, headers, err := buildConfig(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("test"), config.HMACKey)
+	assert.True(t, config.DisableKeepAlivesBE)
+	assert.False(t, config.DisableKeepAlivesFE)
+	assert.Equal(t, int64(10*1024), config.MaxSize)
+	assert.Equal(t, "my-camo", config.ServerName)
+	if assert.Equal(t, 1, len(config.TrustedProxies)) {
+		assert.Equal(t, "10.0.0.0/8", config.TrustedProxies[0].String())
+	}
+	assert.True(t, config.DisableForwardedFor)
+	assert.Equal(t, "nosniff", headers["X-Content-Type-Options"])
+
+	bad := [][]string{
+		{"-k", "test", "--trace-sample-ratio", "2"},
+		{"-k", "test", "--access-log-format", "xml"},
+		{"-k", "test", "--cache-min-ttl", "1h", "--cache-max-ttl", "1m"},
+		{"-k", "test", "--ssl-listen", "0.0.0.0:8443"},
+		{"-k", "test", "--proxy-protocol"},
+		{"-k", "test", "--proxy-protocol-trusted", "10.0.0.0/33"},
+		{"-k", "test", "--trusted-proxy", "10.0.0"},
+		{"-k", "test", "--top-hosts", "10"},
+	}
+	for _, args := range bad {
+		opts, err := parseOptions(args)
+		assert.Nil(t, err)
+		_, _, err = buildConfig(opts)
+		assert.NotNil(t, err, "%v", args)
+	}
+}
+
+func TestParseOptionsEnv(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"key": "filekey",
+		"max-size": 100,
+		"timeout": "10s"
+	}`)
+	t.Setenv("GOCAMO_HMAC", "envkey")
+	t.Setenv("GOCAMO_MAX_SIZE", "200")
+	t.Setenv("GOCAMO_STATS", "true")
+	t.Setenv("GOCAMO_HEADER", "X-Foo: bar, baz\nX-Bar: qux")
+	t.Setenv("GOCAMO_STATSD_TAG", "env:prod,region:us")
+
+	opts, err := parseOptions([]string{"--config", path, "--max-size", "300"})
+	assert.Nil(t, err)
+	assert.Equal(t, "envkey", opts.HMACKey, "env overrides config file")
+	assert.Equal(t, int64(300), opts.MaxSize, "flags override env")
+	assert.Equal(t, 10*time.Second, opts.ReqTimeout)
+	assert.True(t, opts.Stats)
+	assert.Equal(t, []string{"X-Foo: bar, baz", "X-Bar: qux"}, opts.AddHeaders)
+	assert.Equal(t, []string{"env:prod", "region:us"}, opts.StatsdTags)
+
+	t.Setenv("GOCAMO_CONFIG", path)
+	t.Setenv("GOCAMO_STATS", "false")
+	os.Unsetenv("GOCAMO_HMAC")
+	opts, err = parseOptions(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "filekey", opts.HMACKey)
+	assert.False(t, opts.Stats)
+}
+
+// writeCAFile writes a self signed CA certificate to a temp file, and returns
+// its path.
+func writeCAFile(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeConfigFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	opts, err := parseOptions(nil)
+	assert.Nil(t, err)
+	tc, err := buildTLSConfig(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), tc.MinVersion)
+	assert.Nil(t, tc.CipherSuites)
+	assert.Nil(t, tc.CurvePreferences)
+	assert.Equal(t, tls.NoClientCert, tc.ClientAuth)
+
+	ca := writeCAFile(t)
+	opts, err = parseOptions([]string{
+		"--ssl-min-version", "1.3",
+		"--ssl-cipher", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		"--ssl-cipher", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"--ssl-curve", "X25519", "--ssl-curve", "p-256",
+		"--ssl-client-ca", ca,
+	})
+	assert.Nil(t, err)
+	tc, err = buildTLSConfig(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tc.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, tc.CipherSuites)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, tc.CurvePreferences)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tc.ClientAuth)
+	assert.NotNil(t, tc.ClientCAs)
+
+	opts, err = parseOptions([]string{"--ssl-client-ca", ca, "--ssl-client-cert-optional"})
+	assert.Nil(t, err)
+	tc, err = buildTLSConfig(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, tc.ClientAuth)
+
+	bad := [][]string{
+		{"--ssl-min-version", "1.4"},
+		{"--ssl-cipher", "TLS_NOT_A_CIPHER"},
+		// insecure suites are not accepted
+		{"--ssl-cipher", "TLS_RSA_WITH_RC4_128_SHA"},
+		{"--ssl-curve", "P-224"},
+		{"--ssl-client-ca", "/nonexistent/ca.pem"},
+		{"--ssl-client-ca", writeConfigFile(t, "not a cert")},
+	}
+	for _, args := range bad {
+		opts, err := parseOptions(args)
+		assert.Nil(t, err)
+		_, err = buildTLSConfig(opts)
+		assert.NotNil(t, err, "%v", args)
+	}
+}
+
+func TestUnixOptions(t *testing.T) {
+	opts, err := parseOptions(nil)
+	assert.Nil(t, err)
+	uo, err := unixOptions(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), uo.Mode)
+	assert.Equal(t, -1, uo.Group)
+
+	gid := os.Getgid()
+	opts, err = parseOptions([]string{"--socket-mode", "600", "--socket-group", strconv.Itoa(gid)})
+	assert.Nil(t, err)
+	uo, err = unixOptions(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), uo.Mode)
+	assert.Equal(t, gid, uo.Group)
+
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		opts, err = parseOptions([]string{"--socket-group", g.Name})
+		assert.Nil(t, err)
+		uo, err = unixOptions(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, gid, uo.Group)
+	}
+
+	for _, args := range [][]string{
+		{"--socket-mode", "999"},
+		{"--socket-mode", "01777"},
+		{"--socket-group", "no-such-group-go-camo"},
+	} {
+		opts, err := parseOptions(args)
+		assert.Nil(t, err)
+		_, err = unixOptions(opts)
+		assert.NotNil(t, err, "%v", args)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", " ::1 "})
+	assert.Nil(t, err)
+	if assert.Equal(t, 4, len(nets)) {
+		assert.Equal(t, "10.0.0.0/8", nets[0].String())
+		assert.Equal(t, "192.0.2.1/32", nets[1].String())
+		assert.Equal(t, "2001:db8::/32", nets[2].String())
+		assert.Equal(t, "::1/128", nets[3].String())
+	}
+
+	for _, v := range []string{"10.0.0.0/33", "10.0.0", "example.com"} {
+		_, err := parseCIDRs([]string{v})
+		assert.NotNil(t, err, v)
+	}
+
+	// unix domain sockets don't need a trusted network
+	opts, err := parseOptions([]string{"-k", "test", "--proxy-protocol", "--listen", "unix:/tmp/camo.sock"})
+	assert.Nil(t, err)
+	_, _, err = buildConfig(opts)
+	assert.Nil(t, err)
+}
+
+func TestServerOptions(t *testing.T) {
+	opts, err := parseOptions([]string{"-k", "test"})
+	assert.Nil(t, err)
+	_, _, err = buildConfig(opts)
+	assert.Nil(t, err)
+	srv := newServer(opts, "127.0.0.1:8080")
+	assert.Equal(t, "127.0.0.1:8080", srv.Addr)
+	assert.Equal(t, 30*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 10*time.Second, srv.ReadHeaderTimeout)
+	assert.Equal(t, 60*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 120*time.Second, srv.IdleTimeout)
+	assert.Equal(t, 65536, srv.MaxHeaderBytes)
+
+	for _, args := range [][]string{
+		{"-k", "test", "--read-timeout", "-1s"},
+		{"-k", "test", "--idle-timeout", "-1s"},
+		{"-k", "test", "--write-timeout", "4s", "--timeout", "4s"},
+		{"-k", "test", "--max-header-bytes", "0"},
+	} {
+		opts, err := parseOptions(args)
+		assert.Nil(t, err)
+		_, _, err = buildConfig(opts)
+		assert.NotNil(t, err, "%v", args)
+	}
+
+	// no write timeout at all is allowed
+	opts, err = parseOptions([]string{"-k", "test", "--write-timeout", "0"})
+	assert.Nil(t, err)
+	_, _, err = buildConfig(opts)
+	assert.Nil(t, err)
+}
+
+// startServer serves a handler that reads the request body, and replies
+// "ok", with a server built from args. It returns the server's address.
+func startServer(t *testing.T, args ...string) string {
+	opts, err := parseOptions(append([]string{"-k", "test"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(opts, l.Addr().String())
+	srv.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// trickle writes each of parts to c, pausing between them, as a slow (or
+// slowloris) client would. It stops at the first write error.
+func trickle(c net.Conn, pause time.Duration, parts ...string) {
+	for _, p := range parts {
+		if _, err := io.WriteString(c, p); err != nil {
+			return
+		}
+		time.Sleep(pause)
+	}
+}
+
+// waitClosed reads from c until the server closes it, and returns what was
+// read, and how long it took.
+func waitClosed(c net.Conn) (string, time.Duration) {
+	start := time.Now()
+	c.SetReadDeadline(start.Add(10 * time.Second))
+	b, _ := ioutil.ReadAll(c)
+	return string(b), time.Since(start)
+}
+
+func TestServerSlowHeaders(t *testing.T) {
+	t.Parallel()
+	addr := startServer(t, "--read-header-timeout", "200ms")
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	headers := []string{"GET / HTTP/1.1\r\nHost: example.com\r\n"}
+	for i := 0; i < 50; i++ {
+		headers = append(headers, "X-Slow: 1\r\n")
+	}
+	go trickle(c, 100*time.Millisecond, headers...)
+	resp, d := waitClosed(c)
+	assert.False(t, strings.Contains(resp, "ok"), resp)
+	assert.True(t, d < 2*time.Second, "closed after %s", d)
+}
+
+func TestServerSlowBody(t *testing.T) {
+	t.Parallel()
+	addr := startServer(t, "--read-timeout", "300ms")
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	parts := []string{"POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 50\r\n\r\n"}
+	for i := 0; i < 50; i++ {
+		parts = append(parts, "x")
+	}
+	go trickle(c, 100*time.Millisecond, parts...)
+	resp, d := waitClosed(c)
+	assert.False(t, strings.Contains(resp, "ok"), resp)
+	assert.True(t, d < 2*time.Second, "closed after %s", d)
+}
+
+func TestServerIdle(t *testing.T) {
+	t.Parallel()
+	addr := startServer(t, "--idle-timeout", "200ms")
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	// the kept alive connection is closed once idle for too long
+	start := time.Now()
+	c.SetReadDeadline(start.Add(10 * time.Second))
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	d := time.Since(start)
+	assert.True(t, d > 100*time.Millisecond && d < 2*time.Second, "closed after %s", d)
+}
+
+func TestServerMaxHeaderBytes(t *testing.T) {
+	t.Parallel()
+	addr := startServer(t, "--max-header-bytes", "1024")
+
+	send := func(header string) int {
+		c, err := net.Dial("tcp", addr)
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		defer c.Close()
+		go io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Big: "+header+"\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, 200, send(strings.Repeat("x", 512)))
+	// go allows 4096 bytes of slack over the limit
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, send(strings.Repeat("x", 8192)))
+}
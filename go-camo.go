@@ -2,21 +2,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
-	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/cactus/go-camo/camo"
+	"github.com/cactus/go-camo/certs"
+	"github.com/cactus/go-camo/listener"
+	"github.com/cactus/go-camo/logging"
 	"github.com/cactus/go-camo/router"
 	"github.com/cactus/go-camo/stats"
-	"github.com/cactus/gologit"
+	"github.com/cactus/go-camo/trace"
 	flags "github.com/jessevdk/go-flags"
 )
 
@@ -25,6 +30,73 @@ var (
 	ServerVersion = "no-version"
 )
 
+// options holds the command line flags (and their environment variable and
+// config file equivalents)
+type options struct {
+	ConfigFile          string        `long:"config" env:"GOCAMO_CONFIG" description:"Config file, in JSON (.json) or TOML (.toml). Options given on the command line override those in the file"`
+	CheckConfig         bool          `long:"check-config" description:"Validate the configuration and exit"`
+	HMACKey             string        `short:"k" long:"key" env:"GOCAMO_HMAC" description:"HMAC key"`
+	AdminToken          string        `long:"admin-token" env:"GOCAMO_ADMIN_TOKEN" description:"Bearer token required by admin endpoints (/explain, /log-level, /reload). Admin endpoints are disabled if not set"`
+	AddHeaders          []string      `short:"H" long:"header" env:"GOCAMO_HEADER" env-delim:"\n" description:"Extra header to return for each response. This option can be used multiple times to add multiple headers"`
+	Stats               bool          `long:"stats" env:"GOCAMO_STATS" description:"Enable Stats"`
+	Prometheus          bool          `long:"prometheus" env:"GOCAMO_PROMETHEUS" description:"Enable Prometheus metrics at /metrics"`
+	TopHosts            int           `long:"top-hosts" env:"GOCAMO_TOP_HOSTS" description:"Track at least this many of the busiest upstream hosts, and report them at /top-hosts. Requires admin-token"`
+	StatsdAddress       string        `long:"statsd" env:"GOCAMO_STATSD" description:"Address:Port of a StatsD server to send metrics to"`
+	StatsdPrefix        string        `long:"statsd-prefix" env:"GOCAMO_STATSD_PREFIX" default:"gocamo" description:"Prefix for StatsD metric names"`
+	StatsdTags          []string      `long:"statsd-tag" env:"GOCAMO_STATSD_TAG" env-delim:"," description:"DogStatsD tag (key:value) to add to StatsD metrics. This option can be used multiple times to add multiple tags"`
+	StatsdInterval      time.Duration `long:"statsd-interval" env:"GOCAMO_STATSD_INTERVAL" default:"10s" description:"Interval between sending StatsD metrics"`
+	OTLPEndpoint        string        `long:"otlp-endpoint" env:"GOCAMO_OTLP_ENDPOINT" description:"URL of an OTLP/HTTP collector to send trace spans to (eg. http://localhost:4318/v1/traces)"`
+	OTLPInterval        time.Duration `long:"otlp-interval" env:"GOCAMO_OTLP_INTERVAL" default:"5s" description:"Interval between sending batched trace spans"`
+	TraceSampleRatio    float64       `long:"trace-sample-ratio" env:"GOCAMO_TRACE_SAMPLE_RATIO" default:"1" description:"Fraction of new traces to record. Traces continued from a traceparent header follow the caller's sampling decision"`
+	AccessLog           string        `long:"access-log" env:"GOCAMO_ACCESS_LOG" description:"Write an access log to this file (- for stdout). The file is reopened on SIGHUP"`
+	AccessLogFormat     string        `long:"access-log-format" env:"GOCAMO_ACCESS_LOG_FORMAT" default:"combined" description:"Access log format (combined or json)"`
+	AllowList           string        `long:"allow-list" env:"GOCAMO_ALLOW_LIST" description:"Text file of hostname allow regexes (one per line)"`
+	ServerName          string        `long:"server-name" env:"GOCAMO_SERVER_NAME" description:"Name sent in the Server and Via headers, and used to detect request loops (default: go-camo)"`
+	MaxSize             int64         `long:"max-size" env:"GOCAMO_MAX_SIZE" default:"5120" description:"Max response image size (KB)"`
+	ReqTimeout          time.Duration `long:"timeout" env:"GOCAMO_TIMEOUT" default:"4s" description:"Upstream request timeout"`
+	MaxRedirects        int           `long:"max-redirects" env:"GOCAMO_MAX_REDIRECTS" default:"3" description:"Maximum number of redirects to follow"`
+	DisableKeepAlivesFE bool          `long:"no-fk" env:"GOCAMO_NO_FK" description:"Disable frontend http keep-alive support"`
+	DisableKeepAlivesBE bool          `long:"no-bk" env:"GOCAMO_NO_BK" description:"Disable backend http keep-alive support"`
+	CacheMinTTL         time.Duration `long:"cache-min-ttl" env:"GOCAMO_CACHE_MIN_TTL" description:"Minimum cache lifetime (max-age) sent for images"`
+	CacheMaxTTL         time.Duration `long:"cache-max-ttl" env:"GOCAMO_CACHE_MAX_TTL" description:"Maximum cache lifetime (max-age) sent for images"`
+	CacheDefaultTTL     time.Duration `long:"cache-default-ttl" env:"GOCAMO_CACHE_DEFAULT_TTL" description:"Cache lifetime sent for images when upstream provides none"`
+	CacheRewritePrivate bool          `long:"cache-rewrite-private" env:"GOCAMO_CACHE_REWRITE_PRIVATE" description:"Rewrite private and no-store Cache-Control directives on images to public"`
+	FallbackImage       string        `long:"fallback-image" env:"GOCAMO_FALLBACK_IMAGE" description:"Image file to serve (with the error status code) in place of text error responses"`
+	ServerTiming        bool          `long:"server-timing" env:"GOCAMO_SERVER_TIMING" description:"Add a Server-Timing header to responses, with the duration of each phase of the request"`
+	ForwardRequestID    bool          `long:"forward-request-id" env:"GOCAMO_FORWARD_REQUEST_ID" description:"Send the X-Request-Id to upstream servers"`
+	TrustedProxies      []string      `long:"trusted-proxy" env:"GOCAMO_TRUSTED_PROXY" env-delim:"," description:"Network (CIDR) or address of a proxy in front of go-camo, whose X-Forwarded-For header is trusted to find the client address. Hops left of the client are not forwarded. This option can be used multiple times"`
+	NoForwardedFor      bool          `long:"no-forwarded-for" env:"GOCAMO_NO_FORWARDED_FOR" description:"Don't send the X-Forwarded-For header to upstream servers"`
+	GenerateRequestID   bool          `long:"generate-request-id" env:"GOCAMO_GENERATE_REQUEST_ID" description:"Ignore X-Request-Id headers sent by clients, and always generate a new request id"`
+	ShutdownDelay       time.Duration `long:"shutdown-delay" env:"GOCAMO_SHUTDOWN_DELAY" description:"On SIGTERM or SIGINT, time to fail readiness checks (at /ready) before no longer accepting connections"`
+	DrainTimeout        time.Duration `long:"drain-timeout" env:"GOCAMO_DRAIN_TIMEOUT" default:"30s" description:"On SIGTERM or SIGINT, maximum time to wait for in-flight requests to finish before exiting"`
+	ReadTimeout         time.Duration `long:"read-timeout" env:"GOCAMO_READ_TIMEOUT" default:"30s" description:"Maximum time to read a client request, including the body (0 for no limit)"`
+	ReadHeaderTimeout   time.Duration `long:"read-header-timeout" env:"GOCAMO_READ_HEADER_TIMEOUT" default:"10s" description:"Maximum time to read client request headers (0 for no limit)"`
+	WriteTimeout        time.Duration `long:"write-timeout" env:"GOCAMO_WRITE_TIMEOUT" default:"60s" description:"Maximum time from reading client request headers to finishing writing the response (0 for no limit). Must be longer than timeout"`
+	IdleTimeout         time.Duration `long:"idle-timeout" env:"GOCAMO_IDLE_TIMEOUT" default:"120s" description:"Maximum time to wait for the next request on a keep-alive connection (0 for no limit)"`
+	MaxHeaderBytes      int           `long:"max-header-bytes" env:"GOCAMO_MAX_HEADER_BYTES" default:"65536" description:"Maximum size in bytes of client request headers, including the request line"`
+	BindAddress         string        `long:"listen" env:"GOCAMO_LISTEN" default:"0.0.0.0:8080" description:"Address:Port to bind to for HTTP. A unix domain socket can be given as unix:/path/to.sock, and a socket inherited by socket activation (LISTEN_FDS) as fd:index or fd:name"`
+	BindAddressSSL      string        `long:"ssl-listen" env:"GOCAMO_SSL_LISTEN" description:"Address:Port to bind to for HTTPS/SSL/TLS. Takes the same forms as listen"`
+	SocketMode          string        `long:"socket-mode" env:"GOCAMO_SOCKET_MODE" default:"0660" description:"Permissions (octal) of unix domain sockets created for listen and ssl-listen"`
+	SocketGroup         string        `long:"socket-group" env:"GOCAMO_SOCKET_GROUP" description:"Group (name or gid) to own unix domain sockets created for listen and ssl-listen"`
+	ProxyProtocol       bool          `long:"proxy-protocol" env:"GOCAMO_PROXY_PROTOCOL" description:"Read a PROXY protocol (v1 or v2) header from connections from proxy-protocol-trusted sources, and use the client address it carries"`
+	ProxyProtocolTrust  []string      `long:"proxy-protocol-trusted" env:"GOCAMO_PROXY_PROTOCOL_TRUSTED" env-delim:"," description:"Network (CIDR) or address of load balancers sending PROXY protocol headers. This option can be used multiple times"`
+	SSLKey              []string      `long:"ssl-key" env:"GOCAMO_SSL_KEY" env-delim:"," description:"ssl private key (key.pem) path. This option can be used multiple times, once for each ssl-cert"`
+	SSLCert             []string      `long:"ssl-cert" env:"GOCAMO_SSL_CERT" env-delim:"," description:"ssl cert (cert.pem) path. This option can be used multiple times, to serve a certificate chosen by SNI"`
+	SSLReloadInterval   time.Duration `long:"ssl-reload-interval" env:"GOCAMO_SSL_RELOAD_INTERVAL" default:"1m" description:"Interval between checking the ssl cert and key files for changes, and reloading them (0 to disable). They are also reloaded on SIGHUP"`
+	SSLOCSPStaples      []string      `long:"ssl-ocsp-staple" env:"GOCAMO_SSL_OCSP_STAPLE" env-delim:"," description:"DER encoded OCSP response file to staple, for the ssl-cert given in the same position. It is reloaded along with the certificates"`
+	SSLMinVersion       string        `long:"ssl-min-version" env:"GOCAMO_SSL_MIN_VERSION" default:"1.2" description:"Minimum TLS version (1.0, 1.1, 1.2 or 1.3)"`
+	SSLCiphers          []string      `long:"ssl-cipher" env:"GOCAMO_SSL_CIPHER" env-delim:"," description:"TLS 1.0-1.2 cipher suite to enable (eg. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256). This option can be used multiple times. Defaults to Go's secure cipher suites"`
+	SSLCurves           []string      `long:"ssl-curve" env:"GOCAMO_SSL_CURVE" env-delim:"," description:"Elliptic curve to use for key exchange (X25519, P-256, P-384 or P-521). This option can be used multiple times. Defaults to Go's curve preferences"`
+	SSLClientCA         string        `long:"ssl-client-ca" env:"GOCAMO_SSL_CLIENT_CA" description:"File of pem encoded CA certificates. If set, TLS clients must present a certificate signed by one of them"`
+	SSLClientOptional   bool          `long:"ssl-client-cert-optional" env:"GOCAMO_SSL_CLIENT_CERT_OPTIONAL" description:"With ssl-client-ca, also allow TLS clients that present no certificate"`
+	HSTS                string        `long:"hsts" env:"GOCAMO_HSTS" description:"Strict-Transport-Security header to send on responses over TLS (eg. max-age=31536000; includeSubDomains)"`
+	LogLevel            string        `long:"log-level" env:"GOCAMO_LOG_LEVEL" default:"info" description:"Minimum log level (debug, info, warn or error). SIGUSR1 toggles debug level"`
+	LogFormat           string        `long:"log-format" env:"GOCAMO_LOG_FORMAT" default:"text" description:"Log format (text or json)"`
+	LogRedactHeaders    []string      `long:"log-redact-header" env:"GOCAMO_LOG_REDACT_HEADER" env-delim:"," description:"Header whose value is redacted in logs, in addition to Authorization, Proxy-Authorization, Cookie and Set-Cookie. This option can be used multiple times"`
+	Verbose             bool          `short:"v" long:"verbose" env:"GOCAMO_VERBOSE" description:"Show verbose (debug) log level output. Same as --log-level=debug"`
+	Version             bool          `short:"V" long:"version" description:"print version and exit"`
+}
+
 func main() {
 	var gmx int
 	if gmxEnv := os.Getenv("GOMAXPROCS"); gmxEnv != "" {
@@ -34,32 +106,15 @@ func main() {
 	}
 	runtime.GOMAXPROCS(gmx)
 
-	// command line flags
-	var opts struct {
-		HMACKey             string        `short:"k" long:"key" description:"HMAC key"`
-		AddHeaders          []string      `short:"H" long:"header" description:"Extra header to return for each response. This option can be used multiple times to add multiple headers"`
-		Stats               bool          `long:"stats" description:"Enable Stats"`
-		AllowList           string        `long:"allow-list" description:"Text file of hostname allow regexes (one per line)"`
-		MaxSize             int64         `long:"max-size" default:"5120" description:"Max response image size (KB)"`
-		ReqTimeout          time.Duration `long:"timeout" default:"4s" description:"Upstream request timeout"`
-		MaxRedirects        int           `long:"max-redirects" default:"3" description:"Maximum number of redirects to follow"`
-		DisableKeepAlivesFE bool          `long:"no-fk" description:"Disable frontend http keep-alive support"`
-		DisableKeepAlivesBE bool          `long:"no-bk" description:"Disable backend http keep-alive support"`
-		BindAddress         string        `long:"listen" default:"0.0.0.0:8080" description:"Address:Port to bind to for HTTP"`
-		BindAddressSSL      string        `long:"ssl-listen" description:"Address:Port to bind to for HTTPS/SSL/TLS"`
-		SSLKey              string        `long:"ssl-key" description:"ssl private key (key.pem) path"`
-		SSLCert             string        `long:"ssl-cert" description:"ssl cert (cert.pem) path"`
-		Verbose             bool          `short:"v" long:"verbose" description:"Show verbose (debug) log level output"`
-		Version             bool          `short:"V" long:"version" description:"print version and exit"`
-	}
-
-	// parse said flags
-	_, err := flags.Parse(&opts)
+	// parse said flags, and config file
+	opts, err := parseOptions(os.Args[1:])
 	if err != nil {
 		if e, ok := err.(*flags.Error); ok {
 			if e.Type == flags.ErrHelp {
 				os.Exit(0)
 			}
+		} else {
+			fmt.Fprintln(os.Stderr, err)
 		}
 		os.Exit(1)
 	}
@@ -69,118 +124,234 @@ func main() {
 		os.Exit(0)
 	}
 
-	config := camo.Config{}
-	if hmacKey := os.Getenv("GOCAMO_HMAC"); hmacKey != "" {
-		config.HMACKey = []byte(hmacKey)
+	if err := logging.Setup(os.Stderr, opts.LogFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-
-	// flags override env var
-	if opts.HMACKey != "" {
-		config.HMACKey = []byte(opts.HMACKey)
+	logLevel, err := logging.ParseLevel(opts.LogLevel)
+	if err != nil {
+		logging.Fatal("bad log-level", "error", err)
+	}
+	if opts.Verbose {
+		logLevel = slog.LevelDebug
 	}
+	logging.SetLevel(logLevel)
+	logging.ToggleDebugOnSignal(syscall.SIGUSR1)
+	for _, h := range opts.LogRedactHeaders {
+		logging.RedactHeader(h)
+	}
+	slog.Debug("debug logging enabled")
 
-	if len(config.HMACKey) == 0 {
-		log.Fatal("HMAC key required")
+	config, addHeaders, err := buildConfig(opts)
+	if err != nil {
+		logging.Fatal("bad configuration", "error", err)
 	}
 
-	if opts.BindAddress == "" && opts.BindAddressSSL == "" {
-		log.Fatal("One of bind-address or bind-ssl-address required")
+	proxy, err := camo.New(config)
+	if err != nil {
+		logging.Fatal("could not create proxy", "error", err)
 	}
 
-	if opts.BindAddressSSL != "" && opts.SSLKey == "" {
-		log.Fatal("ssl-key is required when specifying bind-ssl-address")
+	if opts.CheckConfig {
+		fmt.Println("configuration ok")
+		os.Exit(0)
 	}
-	if opts.BindAddressSSL != "" && opts.SSLCert == "" {
-		log.Fatal("ssl-cert is required when specifying bind-ssl-address")
+
+	dumbrouter := &router.DumbRouter{
+		ServerName:        config.ServerName,
+		AddHeaders:        addHeaders,
+		CamoHandler:       proxy,
+		GenerateRequestID: opts.GenerateRequestID,
+		HSTS:              opts.HSTS,
 	}
 
-	// set keepalive options
-	opts.DisableKeepAlivesBE = config.DisableKeepAlivesBE
-	opts.DisableKeepAlivesFE = config.DisableKeepAlivesFE
+	// flushed and closed on shutdown
+	var closers []io.Closer
 
-	if opts.AllowList != "" {
-		b, err := ioutil.ReadFile(opts.AllowList)
-		if err != nil {
-			log.Fatal("Could not read alllow-list. ", err)
-		}
-		config.AllowList = strings.Split(string(b), "\n")
+	var collectors stats.Multi
+	if opts.Stats {
+		ps := stats.NewProxyStats()
+		ps.ServerVersion = ServerVersion
+		collectors = append(collectors, ps)
+		slog.Info("enabling stats at /status")
+		dumbrouter.StatsHandler = stats.StatsHandler(ps)
 	}
 
-	AddHeaders := map[string]string{
-		"X-Content-Type-Options":  "nosniff",
-		"X-XSS-Protection":        "1; mode=block",
-		"Content-Security-Policy": "default-src 'none'",
+	if opts.Prometheus {
+		pm := stats.NewPrometheusStats()
+		collectors = append(collectors, pm)
+		slog.Info("enabling prometheus metrics at /metrics")
+		dumbrouter.MetricsHandler = stats.PrometheusHandler(pm)
 	}
 
-	for _, v := range opts.AddHeaders {
-		s := strings.SplitN(v, ":", 2)
-		if len(s) != 2 {
-			log.Printf("ignoring bad header: '%s'\n", v)
-			continue
+	if opts.StatsdAddress != "" {
+		ss, err := stats.NewStatsdStats(opts.StatsdAddress, opts.StatsdPrefix,
+			opts.StatsdTags, opts.StatsdInterval)
+		if err != nil {
+			logging.Fatal("could not set up statsd", "error", err)
 		}
+		collectors = append(collectors, ss)
+		closers = append(closers, ss)
+		slog.Info("sending statsd metrics", "address", opts.StatsdAddress)
+	}
 
-		s0 := strings.TrimSpace(s[0])
-		s1 := strings.TrimSpace(s[1])
-
-		if len(s0) == 0 || len(s1) == 0 {
-			log.Printf("ignoring bad header: '%s'\n", v)
-			continue
-		}
-		AddHeaders[s[0]] = s[1]
+	if opts.TopHosts > 0 {
+		th := stats.NewTopHosts(opts.TopHosts)
+		collectors = append(collectors, th)
+		slog.Info("enabling top hosts at /top-hosts")
+		dumbrouter.TopHostsHandler = router.RequireToken(opts.AdminToken, stats.TopHostsHandler(th))
 	}
 
-	// convert from KB to Bytes
-	config.MaxSize = opts.MaxSize * 1024
-	config.RequestTimeout = opts.ReqTimeout
-	config.MaxRedirects = opts.MaxRedirects
-	config.ServerName = ServerName
+	switch len(collectors) {
+	case 0:
+	case 1:
+		proxy.SetMetricsCollector(collectors[0])
+	default:
+		proxy.SetMetricsCollector(collectors)
+	}
 
-	// set logger debug level and start toggle on signal handler
-	logger := gologit.Logger
-	logger.Set(opts.Verbose)
-	logger.Debugln("Debug logging enabled")
-	logger.ToggleOnSignal(syscall.SIGUSR1)
+	// reload the proxy config (and allow list) on SIGHUP, or from /reload
+	rl := &reloader{args: os.Args[1:], proxy: proxy, router: dumbrouter}
+	rl.ReloadOnSignal(syscall.SIGHUP)
 
-	proxy, err := camo.New(config)
-	if err != nil {
-		log.Fatal(err)
+	if opts.AdminToken != "" {
+		slog.Info("enabling admin endpoints at /explain, /log-level and /reload")
+		dumbrouter.ExplainHandler = router.RequireToken(opts.AdminToken, proxy.ExplainHandler)
+		dumbrouter.LogLevelHandler = router.RequireToken(opts.AdminToken, logging.LevelHandler)
+		dumbrouter.ReloadHandler = router.RequireToken(opts.AdminToken, rl.Handler)
 	}
 
-	dumbrouter := &router.DumbRouter{
-		ServerName:      config.ServerName,
-		AddHeaders:      AddHeaders,
-		CamoHandler:     proxy,
+	if opts.OTLPEndpoint != "" {
+		exporter := trace.NewOTLPExporter(opts.OTLPEndpoint, config.ServerName, opts.OTLPInterval)
+		proxy.SetTracer(trace.NewTracer(exporter, opts.TraceSampleRatio))
+		closers = append(closers, exporter)
+		slog.Info("sending trace spans", "endpoint", opts.OTLPEndpoint)
 	}
 
-	if opts.Stats {
-		ps := &stats.ProxyStats{}
-		proxy.SetMetricsCollector(ps)
-		log.Println("Enabling stats at /status")
-		dumbrouter.StatsHandler = stats.StatsHandler(ps)
+	var handler http.Handler = dumbrouter
+	if opts.AccessLog != "" {
+		al, err := router.NewAccessLogger(opts.AccessLog, opts.AccessLogFormat)
+		if err != nil {
+			logging.Fatal("could not open access log", "error", err)
+		}
+		al.ReopenOnSignal(syscall.SIGHUP)
+		closers = append(closers, al)
+		slog.Info("writing access log", "path", opts.AccessLog)
+		handler = al.Handler(dumbrouter)
 	}
 
-	http.Handle("/", dumbrouter)
+	http.Handle("/", handler)
 
+	// listen for shutdown signals before starting, so none are missed
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+
+	var servers []*http.Server
+	errc := make(chan error, 2)
+	uo, err := unixOptions(opts)
+	if err != nil {
+		logging.Fatal("bad configuration", "error", err)
+	}
+	proxyTrusted, err := parseCIDRs(opts.ProxyProtocolTrust)
+	if err != nil {
+		logging.Fatal("bad configuration", "error", err)
+	}
 	if opts.BindAddress != "" {
-		log.Println("Starting server on", opts.BindAddress)
+		l, err := listener.Listen(opts.BindAddress, uo)
+		if err != nil {
+			logging.Fatal("could not listen", "addr", opts.BindAddress, "error", err)
+		}
+		if opts.ProxyProtocol {
+			l = listener.NewProxyListener(l, proxyTrusted)
+		}
+		slog.Info("starting server", "addr", opts.BindAddress)
+		srv := newServer(opts, opts.BindAddress)
+		servers = append(servers, srv)
 		go func() {
-			srv := &http.Server{
-				Addr:        opts.BindAddress,
-				ReadTimeout: 30 * time.Second}
-			log.Fatal(srv.ListenAndServe())
+			errc <- srv.Serve(l)
 		}()
 	}
 	if opts.BindAddressSSL != "" {
-		log.Println("Starting TLS server on", opts.BindAddressSSL)
+		store, err := certs.NewStore(sslKeyPairs(opts))
+		if err != nil {
+			logging.Fatal("could not load ssl certificates", "error", err)
+		}
+		store.ReloadOnSignal(syscall.SIGHUP)
+		if opts.SSLReloadInterval > 0 {
+			store.Watch(opts.SSLReloadInterval)
+		}
+		closers = append(closers, store)
+
+		l, err := listener.Listen(opts.BindAddressSSL, uo)
+		if err != nil {
+			logging.Fatal("could not listen", "addr", opts.BindAddressSSL, "error", err)
+		}
+		if opts.ProxyProtocol {
+			l = listener.NewProxyListener(l, proxyTrusted)
+		}
+		slog.Info("starting TLS server", "addr", opts.BindAddressSSL)
+		tlsConfig, err := buildTLSConfig(opts)
+		if err != nil {
+			logging.Fatal("bad tls configuration", "error", err)
+		}
+		tlsConfig.GetCertificate = store.GetCertificate
+		srv := newServer(opts, opts.BindAddressSSL)
+		srv.TLSConfig = tlsConfig
+		servers = append(servers, srv)
 		go func() {
-			srv := &http.Server{
-				Addr:        opts.BindAddressSSL,
-				ReadTimeout: 30 * time.Second}
-			log.Fatal(srv.ListenAndServeTLS(opts.SSLCert, opts.SSLKey))
+			errc <- srv.ServeTLS(l, "", "")
 		}()
 	}
 
-	// just block. listen and serve will exit the program if they fail/return
-	// so we just need to block to prevent main from exiting.
-	select {}
+	// block until a server fails, or we are asked to shut down
+	select {
+	case err := <-errc:
+		logging.Fatal("server failed", "error", err)
+	case sig := <-sigc:
+		slog.Info("shutting down", "signal", sig.String())
+	}
+
+	// a second signal skips draining
+	go func() {
+		sig := <-sigc
+		logging.Fatal("exiting without draining", "signal", sig.String())
+	}()
+
+	// fail readiness checks, and give load balancers time to notice before
+	// no longer accepting connections
+	dumbrouter.SetDraining(true)
+	if opts.ShutdownDelay > 0 {
+		slog.Info("waiting before draining", "delay", opts.ShutdownDelay.String())
+		time.Sleep(opts.ShutdownDelay)
+	}
+
+	drain(servers, opts.DrainTimeout)
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			slog.Warn("error flushing on shutdown", "error", err)
+		}
+	}
+	slog.Info("shutdown complete")
+}
+
+// drain stops servers from accepting new connections, and waits up to
+// timeout for in-flight requests to finish. Connections still active after
+// timeout are closed.
+func drain(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("drain timeout exceeded, closing connections",
+					"addr", srv.Addr, "error", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
 }
@@ -0,0 +1,190 @@
+// Package listener creates the network listeners for go-camo's servers, from
+// tcp addresses, unix domain socket paths, or sockets inherited from a
+// service manager (systemd style socket activation).
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Address prefixes
+const (
+	// UnixPrefix prefixes the path of a unix domain socket, eg.
+	// unix:/run/go-camo.sock
+	UnixPrefix = "unix:"
+	// FDPrefix prefixes the index (from 0), or name, of an inherited
+	// socket, eg. fd:0 or fd:http
+	FDPrefix = "fd:"
+)
+
+// first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// UnixOptions sets the permissions of unix domain sockets created by
+// Listen.
+type UnixOptions struct {
+	// Mode is the permission bits of the socket file
+	Mode os.FileMode
+	// Group is the gid to own the socket file, or -1 to leave it unchanged
+	Group int
+}
+
+// Listen returns a listener for addr, which is either a tcp "address:port",
+// a unix domain socket path prefixed with "unix:", or an inherited socket
+// prefixed with "fd:". uo is applied to unix domain sockets.
+func Listen(addr string, uo UnixOptions) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, UnixPrefix):
+		return listenUnix(strings.TrimPrefix(addr, UnixPrefix), uo)
+	case strings.HasPrefix(addr, FDPrefix):
+		return inherited(strings.TrimPrefix(addr, FDPrefix))
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+func listenUnix(path string, uo UnixOptions) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("empty unix socket path")
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, uo.Mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if uo.Group >= 0 {
+		if err := os.Chown(path, -1, uo.Group); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes a socket file left at path by a process that
+// didn't shut down cleanly. Files that aren't sockets, and sockets that are
+// still accepting connections, are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists, and is not a socket", path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// inheritedListener is a socket passed by the service manager
+type inheritedListener struct {
+	name string
+	l    net.Listener
+	used bool
+}
+
+var (
+	inheritOnce sync.Once
+	inheritMu   sync.Mutex
+	inheritList []*inheritedListener
+	inheritErr  error
+)
+
+// inherited returns the inherited socket with index or name key. Each
+// socket can only be used once.
+func inherited(key string) (net.Listener, error) {
+	inheritOnce.Do(func() {
+		inheritList, inheritErr = activationListeners(os.Getenv("LISTEN_PID"),
+			os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), listenFDsStart)
+		// not to be passed on to child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if inheritErr != nil {
+		return nil, inheritErr
+	}
+
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	var il *inheritedListener
+	if i, err := strconv.Atoi(key); err == nil {
+		if i >= 0 && i < len(inheritList) {
+			il = inheritList[i]
+		}
+	} else {
+		for _, v := range inheritList {
+			if v.name == key {
+				il = v
+				break
+			}
+		}
+	}
+	if il == nil {
+		return nil, fmt.Errorf("no inherited socket '%s' (%d passed)", key, len(inheritList))
+	}
+	if il.used {
+		return nil, fmt.Errorf("inherited socket '%s' is already in use", key)
+	}
+	il.used = true
+	return il.l, nil
+}
+
+// activationListeners returns listeners for the sockets passed by socket
+// activation, as described by the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+// environment variables, starting at file descriptor firstFD. No sockets are
+// returned if they were meant for another process.
+func activationListeners(pid, nfds, names string, firstFD int) ([]*inheritedListener, error) {
+	if pid == "" || nfds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(nfds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("bad LISTEN_FDS '%s'", nfds)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	list := make([]*inheritedListener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %d: %s", fd, err)
+		}
+		list = append(list, &inheritedListener{name: name, l: l})
+	}
+	return list, nil
+}
@@ -0,0 +1,126 @@
+package listener
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "go-camo-listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func assertAccepts(t *testing.T, l net.Listener) {
+	go func() {
+		c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := l.Accept()
+	assert.Nil(t, err)
+	if c != nil {
+		c.Close()
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	t.Parallel()
+	l, err := Listen("127.0.0.1:0", UnixOptions{})
+	assert.Nil(t, err)
+	defer l.Close()
+	assert.Equal(t, "tcp", l.Addr().Network())
+	assertAccepts(t, l)
+}
+
+func TestListenUnix(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(tempDir(t), "camo.sock")
+	l, err := Listen(UnixPrefix+path, UnixOptions{Mode: 0600, Group: -1})
+	assert.Nil(t, err)
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	assertAccepts(t, l)
+
+	// in use
+	_, err = Listen(UnixPrefix+path, UnixOptions{Mode: 0600, Group: -1})
+	assert.NotNil(t, err)
+
+	// the socket file is removed on close
+	l.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = Listen(UnixPrefix, UnixOptions{Mode: 0600, Group: -1})
+	assert.NotNil(t, err, "empty path")
+}
+
+func TestListenUnixStale(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	path := filepath.Join(dir, "camo.sock")
+
+	// leave a socket file behind, as a crashed process would
+	l, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+
+	l, err = Listen(UnixPrefix+path, UnixOptions{Mode: 0660, Group: os.Getgid()})
+	assert.Nil(t, err)
+	defer l.Close()
+	assertAccepts(t, l)
+
+	// regular files are not removed
+	file := filepath.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(file, nil, 0600))
+	_, err = Listen(UnixPrefix+file, UnixOptions{Mode: 0600, Group: -1})
+	assert.NotNil(t, err)
+	_, err = os.Stat(file)
+	assert.Nil(t, err)
+}
+
+func TestActivationListeners(t *testing.T) {
+	t.Parallel()
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer tl.Close()
+	f, err := tl.(*net.TCPListener).File()
+	assert.Nil(t, err)
+	// activationListeners takes ownership of the descriptor
+	fd := int(f.Fd())
+	pid := strconv.Itoa(os.Getpid())
+
+	list, err := activationListeners(pid, "1", "http", fd)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(list)) {
+		assert.Equal(t, "http", list[0].name)
+		assert.Equal(t, tl.Addr().String(), list[0].l.Addr().String())
+		assertAccepts(t, list[0].l)
+		list[0].l.Close()
+	}
+
+	// meant for another process, or not activated
+	list, err = activationListeners("1", "1", "", fd)
+	assert.Nil(t, err)
+	assert.Nil(t, list)
+	list, err = activationListeners("", "", "", fd)
+	assert.Nil(t, err)
+	assert.Nil(t, list)
+
+	_, err = activationListeners(pid, "x", "", fd)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,248 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProxyHeaderTimeout is how long a connection from a trusted source
+// has to send its PROXY protocol header.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1 headers are at most 107 bytes, including the CRLF
+const proxyV1MaxLen = 107
+
+var errProxyHeader = errors.New("missing or invalid PROXY protocol header")
+
+// ProxyListener is a net.Listener that reads the PROXY protocol (v1 or v2)
+// header sent by a load balancer at the start of each connection from a
+// trusted source, and reports the client (and destination) addresses it
+// carries as the connection's RemoteAddr (and LocalAddr). Connections from
+// trusted sources must send a header, and are closed if they don't.
+// Connections from other sources are passed through as is. Connections
+// that aren't over IP (eg. over unix domain sockets) are trusted.
+type ProxyListener struct {
+	net.Listener
+	// Trusted is the networks that connections must come from for their
+	// header to be read
+	Trusted []*net.IPNet
+	// HeaderTimeout is how long a connection has to send its header
+	HeaderTimeout time.Duration
+}
+
+// NewProxyListener returns a ProxyListener accepting connections from l,
+// and reading headers from connections from trusted networks.
+func NewProxyListener(l net.Listener, trusted []*net.IPNet) *ProxyListener {
+	return &ProxyListener{
+		Listener:      l,
+		Trusted:       trusted,
+		HeaderTimeout: DefaultProxyHeaderTimeout,
+	}
+}
+
+// Accept waits for and returns the next connection. The header is read on
+// the first call to Read, RemoteAddr or LocalAddr, so a slow client doesn't
+// hold up accepting others.
+func (pl *ProxyListener) Accept() (net.Conn, error) {
+	c, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !pl.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, timeout: pl.HeaderTimeout}, nil
+}
+
+func (pl *ProxyListener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, n := range pl.Trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection from a trusted source, starting with a PROXY
+// protocol header.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	br     *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.br = bufio.NewReader(c.Conn)
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		c.remote, c.local, c.err = readProxyHeader(c.br)
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from br, and
+// returns the source and destination addresses in it. The addresses are nil
+// for headers that don't carry them (v1 UNKNOWN, v2 LOCAL, or non-IP
+// families).
+func readProxyHeader(br *bufio.Reader) (remote, local net.Addr, err error) {
+	b, err := br.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, nil, errProxyHeader
+	}
+	if bytes.Equal(b, proxyV1Prefix) {
+		return readProxyV1(br)
+	}
+	b, err = br.Peek(len(proxyV2Sig))
+	if err == nil && bytes.Equal(b, proxyV2Sig) {
+		return readProxyV2(br)
+	}
+	return nil, nil, errProxyHeader
+}
+
+// readProxyV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyV1(br *bufio.Reader) (remote, local net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, errProxyHeader
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+	src, err1 := parseV1Addr(fields[2], fields[4])
+	dst, err2 := parseV1Addr(fields[3], fields[5])
+	if err1 != nil || err2 != nil {
+		return nil, nil, errProxyHeader
+	}
+	if (src.IP.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, nil, errProxyHeader
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return nil, fmt.Errorf("bad address '%s'", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: a, Port: int(p)}, nil
+}
+
+// readProxyV2 reads a binary v2 header
+func readProxyV2(br *bufio.Reader) (remote, local net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, nil, errProxyHeader
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, errProxyHeader
+	}
+
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL: a health check from the proxy itself
+		return nil, nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, nil, errProxyHeader
+	}
+
+	var ipLen int
+	switch fam >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX: no ip addresses to report
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errProxyHeader
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	// any TLVs after the addresses are ignored
+	return src, dst, nil
+}
@@ -0,0 +1,159 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func proxyV2Header(cmd, fam byte, src, dst net.IP, sport, dport uint16, tlv []byte) []byte {
+	var body bytes.Buffer
+	body.Write(src)
+	body.Write(dst)
+	binary.Write(&body, binary.BigEndian, sport)
+	binary.Write(&body, binary.BigEndian, dport)
+	body.Write(tlv)
+
+	var b bytes.Buffer
+	b.Write(proxyV2Sig)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(fam)
+	binary.Write(&b, binary.BigEndian, uint16(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	t.Parallel()
+	v4src, v4dst := net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()
+	v6src, v6dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+
+	tests := []struct {
+		name   string
+		header string
+		remote string
+		local  string
+		ok     bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324", "192.0.2.2:443", true},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", "", true},
+		{"v1 unknown with addresses", "PROXY UNKNOWN ::1 ::1 1 2\r\n", "", "", true},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", "", "", false},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 192.0.2.2 70000 443\r\n", "", "", false},
+		{"v1 bad address", "PROXY TCP4 192.0.2 192.0.2.2 1 443\r\n", "", "", false},
+		{"v1 missing field", "PROXY TCP4 192.0.2.1 192.0.2.2 443\r\n", "", "", false},
+		{"v1 no crlf", "PROXY TCP4 192.0.2.1 192.0.2.2 1 443\n", "", "", false},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", "", false},
+		{"v2 tcp4", string(proxyV2Header(1, 0x11, v4src, v4dst, 56324, 443, nil)), "192.0.2.1:56324", "192.0.2.2:443", true},
+		{"v2 tcp6 with tlv", string(proxyV2Header(1, 0x21, v6src, v6dst, 56324, 443, []byte{0x04, 0, 1, 'x'})), "[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+		{"v2 local", string(proxyV2Header(0, 0x00, nil, nil, 0, 0, nil)), "", "", true},
+		{"v2 short addresses", string(proxyV2Header(1, 0x21, v4src, v4dst, 1, 2, nil)), "", "", false},
+		{"v2 bad command", string(proxyV2Header(2, 0x11, v4src, v4dst, 1, 2, nil)), "", "", false},
+		{"v2 truncated", string(proxyV2Header(1, 0x11, v4src, v4dst, 1, 2, nil)[:20]), "", "", false},
+		{"no header", "GET / HTTP/1.1\r\n\r\n", "", "", false},
+		{"empty", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		br := bufio.NewReader(strings.NewReader(tt.header + "GET /"))
+		remote, local, err := readProxyHeader(br)
+		if !tt.ok {
+			assert.NotNil(t, err, tt.name)
+			continue
+		}
+		if !assert.Nil(t, err, tt.name) {
+			continue
+		}
+		if tt.remote == "" {
+			assert.Nil(t, remote, tt.name)
+			assert.Nil(t, local, tt.name)
+		} else {
+			assert.Equal(t, tt.remote, remote.String(), tt.name)
+			assert.Equal(t, tt.local, local.String(), tt.name)
+		}
+		// the rest of the stream is left for the application
+		rest, _ := ioutil.ReadAll(br)
+		assert.Equal(t, "GET /", string(rest), tt.name)
+	}
+}
+
+// acceptOne sends data to pl from a new connection, and returns the accepted
+// connection.
+func acceptOne(t *testing.T, pl net.Listener, data string) (net.Conn, net.Conn) {
+	client, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte(data))
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, client
+}
+
+func TestProxyListener(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	pl := NewProxyListener(l, []*net.IPNet{loopback})
+	defer pl.Close()
+
+	c, client := acceptOne(t, pl, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nhello")
+	assert.Equal(t, "192.0.2.1:56324", c.RemoteAddr().String())
+	assert.Equal(t, "192.0.2.2:443", c.LocalAddr().String())
+	b := make([]byte, 5)
+	_, err = io.ReadFull(c, b)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+	c.Close()
+	client.Close()
+
+	// trusted sources must send a header
+	c, client = acceptOne(t, pl, "GET / HTTP/1.1\r\n\r\n")
+	_, err = c.Read(b)
+	assert.Equal(t, errProxyHeader, err)
+	assert.Equal(t, client.LocalAddr().String(), c.RemoteAddr().String())
+	c.Close()
+	client.Close()
+
+	// and send it in time
+	pl.HeaderTimeout = 50 * time.Millisecond
+	c, client = acceptOne(t, pl, "PROXY TCP4")
+	start := time.Now()
+	_, err = c.Read(b)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+	c.Close()
+	client.Close()
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	pl := NewProxyListener(l, []*net.IPNet{other})
+	defer pl.Close()
+
+	// the header is not interpreted, so can't be used to spoof the address
+	header := "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+	c, client := acceptOne(t, pl, header)
+	defer client.Close()
+	defer c.Close()
+	assert.Equal(t, client.LocalAddr().String(), c.RemoteAddr().String())
+	b := make([]byte, len(header))
+	_, err = io.ReadFull(c, b)
+	assert.Nil(t, err)
+	assert.Equal(t, header, string(b))
+}
@@ -0,0 +1,167 @@
+// Package logging sets up leveled, structured logging (via log/slog) for
+// go-camo, with a runtime adjustable level and redaction of sensitive http
+// headers.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// level is shared by all handlers created by Setup, so it can be changed at
+// runtime.
+var level = new(slog.LevelVar)
+
+// redacted holds the canonical names of headers whose values are not logged
+var (
+	redactMu sync.RWMutex
+	redacted = map[string]bool{
+		"Authorization":       true,
+		"Proxy-Authorization": true,
+		"Cookie":              true,
+		"Set-Cookie":          true,
+	}
+)
+
+// RedactedValue replaces the values of redacted headers
+const RedactedValue = "[REDACTED]"
+
+// Setup installs a new default slog logger, writing to w in format (one of
+// FormatText or FormatJSON). Log lines written via the standard log package
+// go through it too, at info level.
+func Setup(w io.Writer, format string) error {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format {
+	case FormatText:
+		h = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// ParseLevel parses a level name (debug, info, warn or error).
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+// SetLevel sets the minimum level logged.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// Level returns the minimum level logged.
+func Level() slog.Level {
+	return level.Level()
+}
+
+// ToggleDebugOnSignal spawns a goroutine that switches between debug level
+// and the level set at the time of the call each time sig is received.
+func ToggleDebugOnSignal(sig os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig)
+	go func() {
+		prev := Level()
+		for range c {
+			if Level() == slog.LevelDebug {
+				SetLevel(prev)
+			} else {
+				prev = Level()
+				SetLevel(slog.LevelDebug)
+			}
+			slog.Info("log level changed", "level", Level().String())
+		}
+	}()
+}
+
+// Fatal logs msg at error level, and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// RedactHeader adds a header to the set whose values are redacted in logs.
+func RedactHeader(name string) {
+	redactMu.Lock()
+	redacted[http.CanonicalHeaderKey(name)] = true
+	redactMu.Unlock()
+}
+
+// Headers returns a slog.Value for h, with the values of sensitive headers
+// (eg. Authorization and Cookie) redacted.
+func Headers(h http.Header) slog.Value {
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	attrs := make([]slog.Attr, 0, len(h))
+	for k, v := range h {
+		val := strings.Join(v, ", ")
+		if redacted[http.CanonicalHeaderKey(k)] {
+			val = RedactedValue
+		}
+		attrs = append(attrs, slog.String(k, val))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Request returns a slog.Value for r, with its method, url, protocol,
+// remote address and (redacted) headers.
+func Request(r *http.Request) slog.Value {
+	return slog.GroupValue(
+		slog.String("method", r.Method),
+		slog.String("url", r.URL.String()),
+		slog.String("proto", r.Proto),
+		slog.String("remote_addr", r.RemoteAddr),
+		slog.Any("headers", Headers(r.Header)),
+	)
+}
+
+// Response returns a slog.Value for resp, with its status, protocol,
+// content length and (redacted) headers.
+func Response(resp *http.Response) slog.Value {
+	return slog.GroupValue(
+		slog.Int("status", resp.StatusCode),
+		slog.String("proto", resp.Proto),
+		slog.Int64("content_length", resp.ContentLength),
+		slog.Any("headers", Headers(resp.Header)),
+	)
+}
+
+// LevelHandler is an http.HandlerFunc that returns the current log level on
+// GET, and sets it from the level query parameter on PUT or POST.
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT", "POST":
+		l, err := ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, "Bad level", http.StatusBadRequest)
+			return
+		}
+		SetLevel(l)
+		slog.Info("log level changed", "level", l.String())
+	default:
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(200)
+	io.WriteString(w, Level().String()+"\n")
+}
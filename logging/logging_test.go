@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// these tests change package level state, so are not run in parallel
+
+func TestRedactedRequest(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, Setup(&buf, FormatJSON))
+	defer Setup(&bytes.Buffer{}, FormatText)
+	SetLevel(slog.LevelDebug)
+	defer SetLevel(slog.LevelInfo)
+	RedactHeader("x-secret-token")
+
+	req, err := http.NewRequest("GET", "http://example.com/abc", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Cookie", "session=hunter2")
+	req.Header.Set("Authorization", "Bearer hunter2")
+	req.Header.Set("X-Secret-Token", "hunter2")
+	req.Header.Set("Accept", "image/*")
+	slog.Debug("request", "client_request", Request(req))
+
+	assert.NotContains(t, buf.String(), "hunter2")
+	var line struct {
+		Level   string `json:"level"`
+		Msg     string `json:"msg"`
+		Request struct {
+			Method  string            `json:"method"`
+			URL     string            `json:"url"`
+			Headers map[string]string `json:"headers"`
+		} `json:"client_request"`
+	}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "DEBUG", line.Level)
+	assert.Equal(t, "request", line.Msg)
+	assert.Equal(t, "GET", line.Request.Method)
+	assert.Equal(t, "http://example.com/abc", line.Request.URL)
+	assert.Equal(t, RedactedValue, line.Request.Headers["Cookie"])
+	assert.Equal(t, RedactedValue, line.Request.Headers["Authorization"])
+	assert.Equal(t, RedactedValue, line.Request.Headers["X-Secret-Token"])
+	assert.Equal(t, "image/*", line.Request.Headers["Accept"])
+
+	// below the level, not logged
+	buf.Reset()
+	SetLevel(slog.LevelInfo)
+	slog.Debug("hidden")
+	assert.Equal(t, 0, buf.Len())
+
+	assert.NotNil(t, Setup(&buf, "xml"))
+}
+
+func TestLevelHandler(t *testing.T) {
+	defer SetLevel(slog.LevelInfo)
+	SetLevel(slog.LevelInfo)
+
+	req, err := http.NewRequest("GET", "http://example.com/log-level", nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	LevelHandler(record, req)
+	assert.Equal(t, 200, record.Code)
+	assert.Equal(t, "INFO\n", record.Body.String())
+
+	req, err = http.NewRequest("PUT", "http://example.com/log-level?level=debug", nil)
+	assert.Nil(t, err)
+	record = httptest.NewRecorder()
+	LevelHandler(record, req)
+	assert.Equal(t, 200, record.Code)
+	assert.Equal(t, "DEBUG\n", record.Body.String())
+	assert.Equal(t, slog.LevelDebug, Level())
+
+	req, err = http.NewRequest("POST", "http://example.com/log-level?level=loud", nil)
+	assert.Nil(t, err)
+	record = httptest.NewRecorder()
+	LevelHandler(record, req)
+	assert.Equal(t, 400, record.Code)
+	assert.Equal(t, slog.LevelDebug, Level())
+
+	req, err = http.NewRequest("DELETE", "http://example.com/log-level", nil)
+	assert.Nil(t, err)
+	record = httptest.NewRecorder()
+	LevelHandler(record, req)
+	assert.Equal(t, 405, record.Code)
+}
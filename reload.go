@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/cactus/go-camo/camo"
+	"github.com/cactus/go-camo/router"
+)
+
+// reloader re-reads the configuration (command line args, environment and
+// config file), and swaps the proxy config and extra response headers into
+// the running proxy and router. Other options, such as listen addresses,
+// only take effect on restart.
+type reloader struct {
+	mu     sync.Mutex
+	args   []string
+	proxy  *camo.Proxy
+	router *router.DumbRouter
+}
+
+// Reload re-reads and validates the configuration, and applies it. If it is
+// invalid, an error is returned and the previous configuration is kept.
+func (rl *reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	opts, err := parseOptions(rl.args)
+	if err != nil {
+		return err
+	}
+	config, addHeaders, err := buildConfig(opts)
+	if err != nil {
+		return err
+	}
+	// the router's Server header can't be changed, so keep the two in step
+	config.ServerName = rl.router.ServerName
+	if err := rl.proxy.Reload(config); err != nil {
+		return err
+	}
+	rl.router.SetAddHeaders(addHeaders)
+	return nil
+}
+
+// reload calls Reload, and logs the outcome.
+func (rl *reloader) reload() error {
+	err := rl.Reload()
+	if err != nil {
+		slog.Error("reload failed, keeping previous configuration", "error", err)
+		return err
+	}
+	slog.Info("configuration reloaded")
+	return nil
+}
+
+// ReloadOnSignal spawns a goroutine that reloads the configuration each time
+// sig is received.
+func (rl *reloader) ReloadOnSignal(sig os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig)
+	go func() {
+		for range c {
+			rl.reload()
+		}
+	}()
+}
+
+// Handler is an http.HandlerFunc that reloads the configuration on POST.
+func (rl *reloader) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	if err := rl.reload(); err != nil {
+		http.Error(w, "Reload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(200)
+	io.WriteString(w, "reloaded\n")
+}
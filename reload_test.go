@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cactus/go-camo/camo"
+	"github.com/cactus/go-camo/camo/encoding"
+	"github.com/cactus/go-camo/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloader(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"key": "test",
+		"header": ["X-Foo: foo"],
+		"server-name": "go-camo-test"
+	}`)
+	args := []string{"--config", path}
+
+	opts, err := parseOptions(args)
+	assert.Nil(t, err)
+	config, addHeaders, err := buildConfig(opts)
+	assert.Nil(t, err)
+	proxy, err := camo.New(config)
+	assert.Nil(t, err)
+	dr := &router.DumbRouter{
+		ServerName:  config.ServerName,
+		AddHeaders:  addHeaders,
+		CamoHandler: proxy,
+	}
+	rl := &reloader{args: args, proxy: proxy, router: dr}
+
+	signed := encoding.B64EncodeURL([]byte("newkey"), "http://8.8.8.8/foo.png")
+	assert.Equal(t, "bad-signature", proxy.Explain(signed).Reason)
+
+	err = ioutil.WriteFile(path, []byte(`{
+		"key": "newkey",
+		"header": ["X-Bar:bar"],
+		"server-name": "other"
+	}`), 0600)
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("POST", "http://example.com/reload", nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	rl.Handler(record, req)
+	assert.Equal(t, 200, record.Code)
+	assert.True(t, proxy.Explain(signed).Allowed)
+
+	req, err = http.NewRequest("GET", "http://example.com/", nil)
+	assert.Nil(t, err)
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, "bar", record.Header().Get("X-Bar"))
+	assert.Equal(t, "", record.Header().Get("X-Foo"))
+	assert.Equal(t, "go-camo-test", record.Header().Get("Server"))
+
+	// a bad config keeps the previous one
+	err = ioutil.WriteFile(path, []byte(`{"key": "", "header": ["X-Baz: baz"]}`), 0600)
+	assert.Nil(t, err)
+	assert.NotNil(t, rl.Reload())
+	assert.True(t, proxy.Explain(signed).Allowed)
+
+	req, err = http.NewRequest("GET", "http://example.com/reload", nil)
+	assert.Nil(t, err)
+	record = httptest.NewRecorder()
+	rl.Handler(record, req)
+	assert.Equal(t, 405, record.Code)
+}
@@ -0,0 +1,95 @@
+// Package reqctx holds the per request values shared by go-camo's router
+// and the camo proxy: the request id, and the RequestInfo filled in for the
+// access log. It lets the proxy read and record them without depending on
+// the router.
+package reqctx
+
+import (
+	"context"
+	"net/http"
+)
+
+// RequestIDHeader is the header used to accept, return, and forward request
+// ids.
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a shallow copy of r with id attached to its context.
+func WithRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// RequestIDFromContext returns the request id attached to ctx, or an empty
+// string if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestInfo holds details about a request, filled in by the handlers that
+// serve it, for use by middleware such as the AccessLogger.
+type RequestInfo struct {
+	// RequestID is the X-Request-Id of the request
+	RequestID string
+	// ClientIP is the client address, when it differs from the peer's (eg.
+	// behind trusted proxies)
+	ClientIP string
+	// UpstreamHost is the host of the decoded (signed) url
+	UpstreamHost string
+	// UpstreamStatus is the status code returned by the upstream server
+	UpstreamStatus int
+	// Reason is the machine readable reason a request failed, if it did
+	Reason string
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a shallow copy of r with a new RequestInfo
+// attached to its context, along with that RequestInfo.
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// RequestInfoFromContext returns the RequestInfo attached to ctx, or nil if
+// there is none. The setters on RequestInfo are safe to call on nil.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// SetRequestID sets the RequestID, if ri is not nil.
+func (ri *RequestInfo) SetRequestID(id string) {
+	if ri != nil {
+		ri.RequestID = id
+	}
+}
+
+// SetClientIP sets the ClientIP, if ri is not nil.
+func (ri *RequestInfo) SetClientIP(ip string) {
+	if ri != nil {
+		ri.ClientIP = ip
+	}
+}
+
+// SetUpstreamHost sets the UpstreamHost, if ri is not nil.
+func (ri *RequestInfo) SetUpstreamHost(host string) {
+	if ri != nil {
+		ri.UpstreamHost = host
+	}
+}
+
+// SetUpstreamStatus sets the UpstreamStatus, if ri is not nil.
+func (ri *RequestInfo) SetUpstreamStatus(code int) {
+	if ri != nil {
+		ri.UpstreamStatus = code
+	}
+}
+
+// SetReason sets the Reason, if ri is not nil.
+func (ri *RequestInfo) SetReason(reason string) {
+	if ri != nil {
+		ri.Reason = reason
+	}
+}
@@ -0,0 +1,245 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cactus/go-camo/reqctx"
+)
+
+// Access log formats
+const (
+	LogFormatCombined = "combined"
+	LogFormatJSON     = "json"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogger is an http middleware that writes one line per request to an
+// access log, in either the combined log format (with extra go-camo fields
+// appended) or as json.
+type AccessLogger struct {
+	format string
+	path   string
+
+	mu  sync.Mutex
+	out io.Writer
+	// set when out is a file we opened, and should reopen/close
+	file *os.File
+}
+
+// NewAccessLogger returns a new AccessLogger writing to the file at path
+// (appending, and creating it if needed), or to stdout if path is "-".
+// format is one of LogFormatCombined or LogFormatJSON.
+func NewAccessLogger(path, format string) (*AccessLogger, error) {
+	switch format {
+	case LogFormatCombined, LogFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format '%s'", format)
+	}
+
+	al := &AccessLogger{format: format, path: path}
+	if path == "-" {
+		al.out = os.Stdout
+		return al, nil
+	}
+	if err := al.Reopen(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// Reopen closes and reopens the log file, eg. after it has been rotated.
+// It is a no-op when logging to stdout.
+func (al *AccessLogger) Reopen() error {
+	if al.path == "-" {
+		return nil
+	}
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	al.mu.Lock()
+	old := al.file
+	al.file = f
+	al.out = f
+	al.mu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// ReopenOnSignal spawns a goroutine that reopens the log file each time sig
+// is received. Reopen errors are logged, and logging continues to the
+// previously open file.
+func (al *AccessLogger) ReopenOnSignal(sig os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig)
+	go func() {
+		for range c {
+			if err := al.Reopen(); err != nil {
+				slog.Error("could not reopen access log", "error", err)
+			}
+		}
+	}()
+}
+
+// Close closes the log file.
+func (al *AccessLogger) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+	al.out = io.Discard
+	return err
+}
+
+// accessLogEntry is a single access log line
+type accessLogEntry struct {
+	Time           time.Time `json:"-"`
+	Timestamp      string    `json:"time"`
+	ClientIP       string    `json:"client_ip"`
+	Method         string    `json:"method"`
+	URI            string    `json:"uri"`
+	Proto          string    `json:"proto"`
+	Status         int       `json:"status"`
+	Bytes          int64     `json:"bytes"`
+	Referer        string    `json:"referer"`
+	UserAgent      string    `json:"user_agent"`
+	UpstreamHost   string    `json:"upstream_host"`
+	UpstreamStatus int       `json:"upstream_status"`
+	LatencyMs      float64   `json:"latency_ms"`
+	Reason         string    `json:"reason"`
+	RequestID      string    `json:"request_id"`
+}
+
+// orDash returns s, or "-" if s is empty, as is convention in the combined
+// log format.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (e *accessLogEntry) combined() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s - - [%s] %s %d %d %s %s %s %d %.3f %s %s\n",
+		orDash(e.ClientIP),
+		e.Time.Format(clfTimeFormat),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status, e.Bytes,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		strconv.Quote(orDash(e.UpstreamHost)),
+		e.UpstreamStatus, e.LatencyMs,
+		orDash(e.Reason),
+		strconv.Quote(orDash(e.RequestID)))
+	return buf.Bytes()
+}
+
+func (al *AccessLogger) write(e *accessLogEntry) {
+	var line []byte
+	if al.format == LogFormatJSON {
+		e.Timestamp = e.Time.Format(time.RFC3339Nano)
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = append(b, '\n')
+	} else {
+		line = e.combined()
+	}
+	al.mu.Lock()
+	al.out.Write(line)
+	al.mu.Unlock()
+}
+
+// Handler returns an http.Handler that serves requests with h, and logs
+// each one. A reqctx.RequestInfo is attached to each request context, for h to fill
+// in.
+func (al *AccessLogger) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := reqctx.WithRequestInfo(r)
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+
+		clientIP := info.ClientIP
+		if clientIP == "" {
+			var err error
+			clientIP, _, err = net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				clientIP = r.RemoteAddr
+			}
+		}
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		al.write(&accessLogEntry{
+			Time:           start,
+			ClientIP:       clientIP,
+			Method:         r.Method,
+			URI:            r.RequestURI,
+			Proto:          r.Proto,
+			Status:         status,
+			Bytes:          lw.bytes,
+			Referer:        r.Referer(),
+			UserAgent:      r.UserAgent(),
+			UpstreamHost:   info.UpstreamHost,
+			UpstreamStatus: info.UpstreamStatus,
+			LatencyMs:      float64(time.Since(start)) / float64(time.Millisecond),
+			Reason:         info.Reason,
+			RequestID:      info.RequestID,
+		})
+	})
+}
+
+// loggingResponseWriter records the status code and number of bytes written
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (lw *loggingResponseWriter) WriteHeader(code int) {
+	if lw.status == 0 {
+		lw.status = code
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *loggingResponseWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(b)
+	lw.bytes += int64(n)
+	return n, err
+}
+
+func (lw *loggingResponseWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (lw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
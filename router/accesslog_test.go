@@ -0,0 +1,122 @@
+package router
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cactus/go-camo/reqctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func testLogHandler(w http.ResponseWriter, r *http.Request) {
+	info := reqctx.RequestInfoFromContext(r.Context())
+	info.SetUpstreamHost("example.org")
+	info.SetUpstreamStatus(404)
+	info.SetReason("upstream-status")
+	http.Error(w, "Not Found", 404)
+}
+
+func logRequest(t *testing.T, al *AccessLogger) {
+	req, err := http.NewRequest("GET", "http://example.com/abc/def", nil)
+	assert.Nil(t, err)
+	req.RequestURI = "/abc/def"
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	record := httptest.NewRecorder()
+	al.Handler(http.HandlerFunc(testLogHandler)).ServeHTTP(record, req)
+	assert.Equal(t, 404, record.Code)
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "access.log")
+	al, err := NewAccessLogger(path, LogFormatCombined)
+	assert.Nil(t, err)
+	defer al.Close()
+
+	logRequest(t, al)
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	line := string(b)
+	assert.True(t, strings.HasPrefix(line, "192.0.2.1 - - ["), line)
+	assert.Contains(t, line, `] "GET /abc/def HTTP/1.1" 404 10 "-" "test-agent" "example.org" 404 `)
+	assert.True(t, strings.HasSuffix(line, " upstream-status \"-\"\n"), line)
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "access.log")
+	al, err := NewAccessLogger(path, LogFormatJSON)
+	assert.Nil(t, err)
+	defer al.Close()
+
+	logRequest(t, al)
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	var e map[string]interface{}
+	assert.Nil(t, json.Unmarshal(b, &e))
+	assert.Equal(t, "192.0.2.1", e["client_ip"])
+	assert.Equal(t, "/abc/def", e["uri"])
+	assert.Equal(t, float64(404), e["status"])
+	assert.Equal(t, float64(10), e["bytes"])
+	assert.Equal(t, "example.org", e["upstream_host"])
+	assert.Equal(t, float64(404), e["upstream_status"])
+	assert.Equal(t, "upstream-status", e["reason"])
+	assert.NotEmpty(t, e["time"])
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	al, err := NewAccessLogger(path, LogFormatCombined)
+	assert.Nil(t, err)
+	defer al.Close()
+
+	logRequest(t, al)
+	assert.Nil(t, os.Rename(path, path+".1"))
+	assert.Nil(t, al.Reopen())
+	logRequest(t, al)
+
+	b, err := ioutil.ReadFile(path + ".1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(b), "\n"))
+	b, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(b), "\n"))
+}
+
+func TestAccessLogBadFormat(t *testing.T) {
+	t.Parallel()
+	_, err := NewAccessLogger("-", "bogus")
+	assert.NotNil(t, err)
+}
+
+func TestAccessLogClientIP(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "access.log")
+	al, err := NewAccessLogger(path, LogFormatCombined)
+	assert.Nil(t, err)
+	defer al.Close()
+
+	// the client address found by the handler (eg. behind trusted proxies)
+	// is logged in place of the peer's
+	req, err := http.NewRequest("GET", "http://example.com/abc/def", nil)
+	assert.Nil(t, err)
+	req.RemoteAddr = "10.0.0.1:1234"
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqctx.RequestInfoFromContext(r.Context()).SetClientIP("198.51.100.1")
+	})
+	al.Handler(h).ServeHTTP(httptest.NewRecorder(), req)
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "198.51.100.1 - - ["), string(b))
+}
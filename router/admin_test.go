@@ -0,0 +1,41 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireToken(t *testing.T) {
+	t.Parallel()
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}
+
+	for _, tt := range []struct {
+		token  string
+		header string
+		code   int
+	}{
+		{"s3cret", "Bearer s3cret", 200},
+		{"s3cret", "", 401},
+		{"s3cret", "Bearer wrong", 401},
+		{"s3cret", "s3cret", 401},
+		// an empty token never authorizes
+		{"", "Bearer ", 401},
+	} {
+		req, err := http.NewRequest("GET", "http://example.com/explain", nil)
+		assert.Nil(t, err)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		record := httptest.NewRecorder()
+		RequireToken(tt.token, ok)(record, req)
+		assert.Equal(t, tt.code, record.Code, tt.header)
+		if tt.code == 401 {
+			assert.NotEmpty(t, record.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// longest client supplied request id that will be accepted
+const maxRequestIDLen = 128
+
+// NewRequestID returns a new random request id.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether a client supplied request id is safe to
+// reuse (and to write to logs): non-empty, not too long, and made up of only
+// printable ascii without spaces or quotes.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
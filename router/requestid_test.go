@@ -0,0 +1,54 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cactus/go-camo/reqctx"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveRequestID(dr *DumbRouter, clientID string) (string, string) {
+	var ctxID string
+	dr.CamoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxID = reqctx.RequestIDFromContext(r.Context())
+	})
+	req, _ := http.NewRequest("GET", "http://example.com/abc/def", nil)
+	if clientID != "" {
+		req.Header.Set(reqctx.RequestIDHeader, clientID)
+	}
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	return record.Header().Get(reqctx.RequestIDHeader), ctxID
+}
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+	dr := &DumbRouter{}
+
+	// generated
+	respID, ctxID := serveRequestID(dr, "")
+	assert.Equal(t, 32, len(respID))
+	assert.Equal(t, respID, ctxID)
+	other, _ := serveRequestID(dr, "")
+	assert.NotEqual(t, respID, other)
+
+	// accepted from client
+	respID, ctxID = serveRequestID(dr, "abc-123")
+	assert.Equal(t, "abc-123", respID)
+	assert.Equal(t, "abc-123", ctxID)
+
+	// invalid client ids are replaced
+	for _, id := range []string{"has space", `quo"te`, strings.Repeat("a", maxRequestIDLen+1)} {
+		respID, _ = serveRequestID(dr, id)
+		assert.NotEqual(t, id, respID)
+		assert.Equal(t, 32, len(respID))
+	}
+
+	// client ids ignored when always generating
+	dr.GenerateRequestID = true
+	respID, _ = serveRequestID(dr, "abc-123")
+	assert.NotEqual(t, "abc-123", respID)
+}
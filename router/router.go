@@ -4,18 +4,54 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync/atomic"
+
+	"github.com/cactus/go-camo/reqctx"
 )
 
 type DumbRouter struct {
-	ServerName   string
-	AddHeaders   map[string]string
-	StatsHandler http.HandlerFunc
-	CamoHandler  http.Handler
+	ServerName     string
+	AddHeaders     map[string]string
+	StatsHandler   http.HandlerFunc
+	MetricsHandler http.HandlerFunc
+	// TopHostsHandler handles its own methods (GET to report, DELETE to
+	// reset)
+	TopHostsHandler http.HandlerFunc
+	// ExplainHandler should be wrapped with RequireToken, as it reveals
+	// configuration details (eg. the allow list)
+	ExplainHandler http.HandlerFunc
+	// LogLevelHandler handles its own methods (GET to report, PUT or POST
+	// to set), and should be wrapped with RequireToken
+	LogLevelHandler http.HandlerFunc
+	// ReloadHandler handles its own methods (POST to reload), and should be
+	// wrapped with RequireToken
+	ReloadHandler http.HandlerFunc
+	CamoHandler   http.Handler
+	// GenerateRequestID, if set, ignores any X-Request-Id sent by the client
+	// and always generates a new one.
+	GenerateRequestID bool
+	// HSTS, if set, is sent as the Strict-Transport-Security header on
+	// responses to requests made over TLS.
+	HSTS string
+
+	// set while shutting down, to fail readiness checks
+	draining atomic.Bool
+	// replaces AddHeaders, once set by SetAddHeaders
+	addHeaders atomic.Pointer[map[string]string]
+}
+
+// SetAddHeaders replaces AddHeaders while the router is serving requests.
+func (dr *DumbRouter) SetAddHeaders(headers map[string]string) {
+	dr.addHeaders.Store(&headers)
 }
 
 func (dr *DumbRouter) SetHeaders(w http.ResponseWriter) {
+	headers := dr.AddHeaders
+	if p := dr.addHeaders.Load(); p != nil {
+		headers = *p
+	}
 	h := w.Header()
-	for k, v := range dr.AddHeaders {
+	for k, v := range headers {
 		h.Set(k, v)
 	}
 	h.Set("Date", formattedDate.String())
@@ -29,6 +65,25 @@ func (dr *DumbRouter) RootHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, dr.ServerName)
 }
 
+// SetDraining sets whether the server is draining connections before
+// shutting down. While draining, ReadyHandler fails.
+func (dr *DumbRouter) SetDraining(draining bool) {
+	dr.draining.Store(draining)
+}
+
+// ReadyHandler is a readiness check http handler for /ready. It returns a
+// 200 normally, and a 503 while draining.
+func (dr *DumbRouter) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if dr.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "draining\n")
+		return
+	}
+	w.WriteHeader(200)
+	io.WriteString(w, "ok\n")
+}
+
 func (dr *DumbRouter) HeadGet(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
 	if r.Method == "HEAD" || r.Method == "GET" {
 		handler(w, r)
@@ -38,9 +93,29 @@ func (dr *DumbRouter) HeadGet(w http.ResponseWriter, r *http.Request, handler ht
 	return
 }
 
+// requestID returns the X-Request-Id sent by the client, if it is valid and
+// allowed, or a newly generated one.
+func (dr *DumbRouter) requestID(r *http.Request) string {
+	if !dr.GenerateRequestID {
+		if id := r.Header.Get(reqctx.RequestIDHeader); validRequestID(id) {
+			return id
+		}
+	}
+	return NewRequestID()
+}
+
 func (dr *DumbRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// set some default headers
 	dr.SetHeaders(w)
+	if dr.HSTS != "" && r.TLS != nil {
+		w.Header().Set("Strict-Transport-Security", dr.HSTS)
+	}
+
+	// tag the request with an id, for correlating logs
+	id := dr.requestID(r)
+	w.Header().Set(reqctx.RequestIDHeader, id)
+	reqctx.RequestInfoFromContext(r.Context()).SetRequestID(id)
+	r = reqctx.WithRequestID(r, id)
 
 	components := strings.Split(r.URL.Path, "/")
 	if len(components) == 3 {
@@ -53,6 +128,36 @@ func (dr *DumbRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == "/metrics" && dr.MetricsHandler != nil {
+		dr.HeadGet(w, r, dr.MetricsHandler)
+		return
+	}
+
+	if r.URL.Path == "/top-hosts" && dr.TopHostsHandler != nil {
+		dr.TopHostsHandler(w, r)
+		return
+	}
+
+	if r.URL.Path == "/explain" && dr.ExplainHandler != nil {
+		dr.HeadGet(w, r, dr.ExplainHandler)
+		return
+	}
+
+	if r.URL.Path == "/log-level" && dr.LogLevelHandler != nil {
+		dr.LogLevelHandler(w, r)
+		return
+	}
+
+	if r.URL.Path == "/reload" && dr.ReloadHandler != nil {
+		dr.ReloadHandler(w, r)
+		return
+	}
+
+	if r.URL.Path == "/ready" {
+		dr.HeadGet(w, r, dr.ReadyHandler)
+		return
+	}
+
 	if r.URL.Path == "/" {
 		dr.HeadGet(w, r, dr.RootHandler)
 		return
@@ -0,0 +1,69 @@
+package router
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyHandler(t *testing.T) {
+	t.Parallel()
+	dr := &DumbRouter{ServerName: "go-camo"}
+
+	req, err := http.NewRequest("GET", "http://example.com/ready", nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, 200, record.Code)
+	assert.Equal(t, "ok\n", record.Body.String())
+
+	dr.SetDraining(true)
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, 503, record.Code)
+	assert.Equal(t, "draining\n", record.Body.String())
+
+	dr.SetDraining(false)
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, 200, record.Code)
+}
+
+func TestSetAddHeaders(t *testing.T) {
+	t.Parallel()
+	dr := &DumbRouter{
+		ServerName: "go-camo",
+		AddHeaders: map[string]string{"X-Foo": "foo"},
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, "foo", record.Header().Get("X-Foo"))
+
+	dr.SetAddHeaders(map[string]string{"X-Bar": "bar"})
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, "", record.Header().Get("X-Foo"))
+	assert.Equal(t, "bar", record.Header().Get("X-Bar"))
+}
+
+func TestHSTS(t *testing.T) {
+	t.Parallel()
+	dr := &DumbRouter{ServerName: "go-camo", HSTS: "max-age=31536000"}
+
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, "", record.Header().Get("Strict-Transport-Security"))
+
+	req.TLS = &tls.ConnectionState{}
+	record = httptest.NewRecorder()
+	dr.ServeHTTP(record, req)
+	assert.Equal(t, "max-age=31536000", record.Header().Get("Strict-Transport-Security"))
+}
@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"sync/atomic"
+
+	"github.com/cactus/go-camo/camo"
+)
+
+// statuses above this are not tracked
+const maxStatusCode = 599
+
+// statusCounters is a set of lock-free counters indexed by http status code.
+type statusCounters [maxStatusCode + 1]atomic.Uint64
+
+func (sc *statusCounters) add(code int) {
+	if code < 0 || code > maxStatusCode {
+		return
+	}
+	sc[code].Add(1)
+}
+
+// snapshot returns the non-zero counters by status code.
+func (sc *statusCounters) snapshot() map[int]uint64 {
+	r := make(map[int]uint64)
+	for code := range sc {
+		if v := sc[code].Load(); v > 0 {
+			r[code] = v
+		}
+	}
+	return r
+}
+
+// reasonCounters is a set of lock-free counters indexed by camo.Reason.
+type reasonCounters [camo.NumReasons]atomic.Uint64
+
+func (rc *reasonCounters) add(reason camo.Reason) {
+	if reason < 0 || int(reason) >= camo.NumReasons {
+		return
+	}
+	rc[reason].Add(1)
+}
+
+func (rc *reasonCounters) snapshot() [camo.NumReasons]uint64 {
+	var r [camo.NumReasons]uint64
+	for i := range rc {
+		r[i] = rc[i].Load()
+	}
+	return r
+}
@@ -0,0 +1,73 @@
+package stats
+
+import (
+	"time"
+
+	"github.com/cactus/go-camo/camo"
+)
+
+// Multi is a camo.ProxyMetrics that forwards to each of its collectors.
+// Calls for the optional camo.ProxyMetricsExtended, camo.ProxyMetricsInFlight
+// and camo.ProxyMetricsHosts interfaces are forwarded to the collectors that
+// implement them.
+type Multi []camo.ProxyMetrics
+
+func (m Multi) AddServed() {
+	for _, c := range m {
+		c.AddServed()
+	}
+}
+
+func (m Multi) AddBytes(bc int64) {
+	for _, c := range m {
+		c.AddBytes(bc)
+	}
+}
+
+func (m Multi) AddResponse(code int) {
+	for _, c := range m {
+		if e, ok := c.(camo.ProxyMetricsExtended); ok {
+			e.AddResponse(code)
+		}
+	}
+}
+
+func (m Multi) AddRejected(reason camo.Reason) {
+	for _, c := range m {
+		if e, ok := c.(camo.ProxyMetricsExtended); ok {
+			e.AddRejected(reason)
+		}
+	}
+}
+
+func (m Multi) AddUpstreamLatency(d time.Duration) {
+	for _, c := range m {
+		if e, ok := c.(camo.ProxyMetricsExtended); ok {
+			e.AddUpstreamLatency(d)
+		}
+	}
+}
+
+func (m Multi) AddInFlight(delta int64) {
+	for _, c := range m {
+		if f, ok := c.(camo.ProxyMetricsInFlight); ok {
+			f.AddInFlight(delta)
+		}
+	}
+}
+
+func (m Multi) AddUpstreamInFlight(delta int64) {
+	for _, c := range m {
+		if f, ok := c.(camo.ProxyMetricsInFlight); ok {
+			f.AddUpstreamInFlight(delta)
+		}
+	}
+}
+
+func (m Multi) AddHost(host string, bc int64, reason camo.Reason) {
+	for _, c := range m {
+		if h, ok := c.(camo.ProxyMetricsHosts); ok {
+			h.AddHost(host, bc, reason)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/cactus/go-camo/camo"
+)
+
+// Default histogram buckets for PrometheusStats.
+var (
+	// upstream latency, in seconds
+	LatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// response size, in bytes
+	SizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10,
+		1 << 20, 4 << 20, 16 << 20}
+)
+
+// histogram is a lock-free histogram in the style of a prometheus histogram.
+type histogram struct {
+	buckets []float64
+	// per bucket (non-cumulative) counts. the last entry is for +Inf.
+	counts  []atomic.Uint64
+	sumBits atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.buckets, v)].Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if h.sumBits.CompareAndSwap(old, sum) {
+			return
+		}
+	}
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), cumulative)
+	}
+	cumulative += h.counts[len(h.buckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(math.Float64frombits(h.sumBits.Load())))
+	// the count is the +Inf bucket, so they agree even while observe runs
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// PrometheusStats is a camo.ProxyMetrics collector that exposes its metrics
+// in the Prometheus text exposition format, via PrometheusHandler. It
+// implements camo.ProxyMetricsExtended and camo.ProxyMetricsInFlight as well.
+// All counters are lock-free.
+type PrometheusStats struct {
+	requests         atomic.Uint64
+	bytes            atomic.Uint64
+	responses        statusCounters
+	rejected         reasonCounters
+	latency          *histogram
+	size             *histogram
+	inFlight         atomic.Int64
+	upstreamInFlight atomic.Int64
+}
+
+// NewPrometheusStats returns a new PrometheusStats using the default
+// histogram buckets.
+func NewPrometheusStats() *PrometheusStats {
+	return &PrometheusStats{
+		latency: newHistogram(LatencyBuckets),
+		size:    newHistogram(SizeBuckets),
+	}
+}
+
+func (ps *PrometheusStats) AddServed() {
+	ps.requests.Add(1)
+}
+
+func (ps *PrometheusStats) AddBytes(bc int64) {
+	if bc < 0 {
+		return
+	}
+	ps.bytes.Add(uint64(bc))
+	ps.size.observe(float64(bc))
+}
+
+func (ps *PrometheusStats) AddResponse(code int) {
+	ps.responses.add(code)
+}
+
+func (ps *PrometheusStats) AddRejected(reason camo.Reason) {
+	ps.rejected.add(reason)
+}
+
+func (ps *PrometheusStats) AddUpstreamLatency(d time.Duration) {
+	ps.latency.observe(d.Seconds())
+}
+
+func (ps *PrometheusStats) AddInFlight(delta int64) {
+	ps.inFlight.Add(delta)
+}
+
+func (ps *PrometheusStats) AddUpstreamInFlight(delta int64) {
+	ps.upstreamInFlight.Add(delta)
+}
+
+// WriteMetrics writes all metrics to w in the Prometheus text format.
+func (ps *PrometheusStats) WriteMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP gocamo_requests_total Requests handled by the proxy.\n")
+	fmt.Fprintf(w, "# TYPE gocamo_requests_total counter\n")
+	fmt.Fprintf(w, "gocamo_requests_total %d\n", ps.requests.Load())
+
+	fmt.Fprintf(w, "# HELP gocamo_response_bytes_total Image bytes sent to clients.\n")
+	fmt.Fprintf(w, "# TYPE gocamo_response_bytes_total counter\n")
+	fmt.Fprintf(w, "gocamo_response_bytes_total %d\n", ps.bytes.Load())
+
+	responses := ps.responses.snapshot()
+	codes := make([]int, 0, len(responses))
+	for code := range responses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprintf(w, "# HELP gocamo_responses_total Responses sent to clients, by status code.\n")
+	fmt.Fprintf(w, "# TYPE gocamo_responses_total counter\n")
+	for _, code := range codes {
+		fmt.Fprintf(w, "gocamo_responses_total{code=\"%d\"} %d\n", code, responses[code])
+	}
+
+	fmt.Fprintf(w, "# HELP gocamo_errors_total Failed requests, by reason.\n")
+	fmt.Fprintf(w, "# TYPE gocamo_errors_total counter\n")
+	rejected := ps.rejected.snapshot()
+	for i := 1; i < camo.NumReasons; i++ {
+		fmt.Fprintf(w, "gocamo_errors_total{reason=\"%s\"} %d\n", camo.Reason(i), rejected[i])
+	}
+
+	ps.latency.write(w, "gocamo_upstream_latency_seconds",
+		"Time taken for upstream to return response headers.")
+	ps.size.write(w, "gocamo_response_size_bytes",
+		"Size of image responses sent to clients.")
+
+	fmt.Fprintf(w, "# HELP gocamo_in_flight_requests Requests currently being handled.\n")
+	fmt.Fprintf(w, "# TYPE gocamo_in_flight_requests gauge\n")
+	fmt.Fprintf(w, "gocamo_in_flight_requests %d\n", ps.inFlight.Load())
+
+	fmt.Fprintf(w, "# HELP gocamo_upstream_in_flight_requests Upstream requests currently in progress.\n")
+	fmt.Fprintf(w, "# TYPE gocamo_upstream_in_flight_requests gauge\n")
+	fmt.Fprintf(w, "gocamo_upstream_in_flight_requests %d\n", ps.upstreamInFlight.Load())
+}
+
+// PrometheusHandler returns an http.HandlerFunc that returns the metrics
+// collected by ps in the Prometheus text exposition format.
+func PrometheusHandler(ps *PrometheusStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		ps.WriteMetrics(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(200)
+		w.Write(buf.Bytes())
+	}
+}
@@ -0,0 +1,115 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/camo"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ camo.ProxyMetricsExtended = &PrometheusStats{}
+	_ camo.ProxyMetricsInFlight = &PrometheusStats{}
+	_ camo.ProxyMetricsExtended = Multi{}
+	_ camo.ProxyMetricsInFlight = Multi{}
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	t.Parallel()
+	ps := NewPrometheusStats()
+	ps.AddServed()
+	ps.AddBytes(2000)
+	ps.AddResponse(200)
+	ps.AddResponse(504)
+	ps.AddRejected(camo.ReasonUpstreamTimeout)
+	ps.AddUpstreamLatency(20 * time.Millisecond)
+	ps.AddInFlight(1)
+	ps.AddInFlight(1)
+	ps.AddInFlight(-1)
+
+	req, err := http.NewRequest("GET", "http://example.com/metrics", nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	PrometheusHandler(ps)(record, req)
+	assert.Equal(t, record.Code, 200)
+	assert.Equal(t, record.HeaderMap.Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8")
+
+	body := record.Body.String()
+	for _, line := range []string{
+		"# TYPE gocamo_requests_total counter\n",
+		"gocamo_requests_total 1\n",
+		"gocamo_response_bytes_total 2000\n",
+		"gocamo_responses_total{code=\"200\"} 1\n",
+		"gocamo_responses_total{code=\"504\"} 1\n",
+		"gocamo_errors_total{reason=\"upstream-timeout\"} 1\n",
+		"gocamo_errors_total{reason=\"bad-signature\"} 0\n",
+		"# TYPE gocamo_upstream_latency_seconds histogram\n",
+		"gocamo_upstream_latency_seconds_bucket{le=\"0.01\"} 0\n",
+		"gocamo_upstream_latency_seconds_bucket{le=\"0.025\"} 1\n",
+		"gocamo_upstream_latency_seconds_bucket{le=\"+Inf\"} 1\n",
+		"gocamo_upstream_latency_seconds_count 1\n",
+		"gocamo_response_size_bytes_bucket{le=\"1024\"} 0\n",
+		"gocamo_response_size_bytes_bucket{le=\"4096\"} 1\n",
+		"gocamo_response_size_bytes_sum 2000\n",
+		"gocamo_in_flight_requests 1\n",
+		"gocamo_upstream_in_flight_requests 0\n",
+	} {
+		assert.Contains(t, body, line)
+	}
+}
+
+func TestHistogramCountMatchesInf(t *testing.T) {
+	t.Parallel()
+	h := newHistogram(LatencyBuckets)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100000; i++ {
+			h.observe(float64(i%20) / 2)
+		}
+	}()
+
+	var inf, count uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		var b bytes.Buffer
+		h.write(&b, "h", "help")
+		for _, line := range strings.Split(b.String(), "\n") {
+			fmt.Sscanf(line, "h_bucket{le=\"+Inf\"} %d", &inf)
+			fmt.Sscanf(line, "h_count %d", &count)
+		}
+		if !assert.Equal(t, inf, count) {
+			break
+		}
+	}
+	assert.Equal(t, uint64(100000), count)
+}
+
+func TestMulti(t *testing.T) {
+	t.Parallel()
+	ps := &ProxyStats{}
+	pm := NewPrometheusStats()
+	m := Multi{ps, pm}
+	m.AddServed()
+	m.AddBytes(10)
+	m.AddRejected(camo.ReasonDenyList)
+	m.AddInFlight(1)
+
+	c, b := ps.GetStats()
+	assert.Equal(t, c, uint64(1))
+	assert.Equal(t, b, uint64(10))
+	assert.Equal(t, ps.GetRejected()[camo.ReasonDenyList], uint64(1))
+	assert.Equal(t, pm.requests.Load(), uint64(1))
+	assert.Equal(t, pm.rejected[camo.ReasonDenyList].Load(), uint64(1))
+	assert.Equal(t, pm.inFlight.Load(), int64(1))
+}
@@ -0,0 +1,82 @@
+package stats
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// how often rolling rates are updated
+const rateTickInterval = 5 * time.Second
+
+// ewma is an exponentially weighted moving average of a per second rate, in
+// the style of unix load averages. tick is expected to be called every
+// rateTickInterval from a single goroutine, while rate may be called from
+// any goroutine.
+type ewma struct {
+	alpha    float64
+	rateBits atomic.Uint64
+	init     bool
+}
+
+func newEWMA(window time.Duration) *ewma {
+	return &ewma{alpha: 1 - math.Exp(-rateTickInterval.Seconds()/window.Seconds())}
+}
+
+// tick updates the average with the count of events seen during the last
+// interval.
+func (e *ewma) tick(count uint64) {
+	instant := float64(count) / rateTickInterval.Seconds()
+	rate := instant
+	if e.init {
+		rate = math.Float64frombits(e.rateBits.Load())
+		rate += e.alpha * (instant - rate)
+	}
+	e.init = true
+	e.rateBits.Store(math.Float64bits(rate))
+}
+
+// rate returns the current per second rate.
+func (e *ewma) rate() float64 {
+	return math.Float64frombits(e.rateBits.Load())
+}
+
+// rollingRates is a set of 1, 5, and 15 minute moving averages of the per
+// second rate of a counter.
+type rollingRates struct {
+	last uint64
+	m1   *ewma
+	m5   *ewma
+	m15  *ewma
+}
+
+func newRollingRates() *rollingRates {
+	return &rollingRates{
+		m1:  newEWMA(time.Minute),
+		m5:  newEWMA(5 * time.Minute),
+		m15: newEWMA(15 * time.Minute),
+	}
+}
+
+// tick updates the rates from the current total of the counter.
+func (rr *rollingRates) tick(total uint64) {
+	delta := total - rr.last
+	rr.last = total
+	rr.m1.tick(delta)
+	rr.m5.tick(delta)
+	rr.m15.tick(delta)
+}
+
+// Rates holds 1, 5, and 15 minute moving averages of a per second rate.
+type Rates struct {
+	M1  float64 `json:"1m"`
+	M5  float64 `json:"5m"`
+	M15 float64 `json:"15m"`
+}
+
+func (rr *rollingRates) rates() Rates {
+	if rr == nil {
+		return Rates{}
+	}
+	return Rates{M1: rr.m1.rate(), M5: rr.m5.rate(), M15: rr.m15.rate()}
+}
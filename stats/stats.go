@@ -1,45 +1,244 @@
 package stats
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"sync"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cactus/go-camo/camo"
 )
 
+// process start time, for reporting uptime
+var startTime = time.Now()
+
+// ProxyStats is a camo.ProxyMetrics collector that keeps running totals,
+// reported by StatsHandler. All counters are lock-free. Rolling rates are
+// only computed for a ProxyStats created with NewProxyStats.
 type ProxyStats struct {
-	sync.RWMutex
-	clients uint64
-	bytes   uint64
+	// ServerVersion, if set, is reported in the json output
+	ServerVersion string
+
+	clients          atomic.Uint64
+	bytes            atomic.Uint64
+	responses        statusCounters
+	rejected         reasonCounters
+	upstreams        atomic.Uint64
+	latency          atomic.Int64
+	inFlight         atomic.Int64
+	upstreamInFlight atomic.Int64
+	clientRates      *rollingRates
+	byteRates        *rollingRates
+	rejectedRates    *rollingRates
+}
+
+// NewProxyStats returns a new ProxyStats, and starts a goroutine that
+// updates its rolling 1, 5, and 15 minute rates.
+func NewProxyStats() *ProxyStats {
+	ps := &ProxyStats{
+		clientRates:   newRollingRates(),
+		byteRates:     newRollingRates(),
+		rejectedRates: newRollingRates(),
+	}
+	go func() {
+		for range time.Tick(rateTickInterval) {
+			ps.tickRates()
+		}
+	}()
+	return ps
+}
+
+func (ps *ProxyStats) tickRates() {
+	c, b := ps.GetStats()
+	ps.clientRates.tick(c)
+	ps.byteRates.tick(b)
+	var rejected uint64
+	for i := range ps.rejected {
+		rejected += ps.rejected[i].Load()
+	}
+	ps.rejectedRates.tick(rejected)
 }
 
 func (ps *ProxyStats) AddServed() {
-	ps.Lock()
-	ps.clients++
-	ps.Unlock()
+	ps.clients.Add(1)
 }
 
 func (ps *ProxyStats) AddBytes(bc int64) {
 	if bc <= 0 {
 		return
 	}
-	ps.Lock()
-	ps.bytes += uint64(bc)
-	ps.Unlock()
+	ps.bytes.Add(uint64(bc))
+}
+
+func (ps *ProxyStats) AddResponse(code int) {
+	ps.responses.add(code)
+}
+
+func (ps *ProxyStats) AddRejected(reason camo.Reason) {
+	ps.rejected.add(reason)
+}
+
+func (ps *ProxyStats) AddUpstreamLatency(d time.Duration) {
+	ps.upstreams.Add(1)
+	ps.latency.Add(int64(d))
+}
+
+func (ps *ProxyStats) AddInFlight(delta int64) {
+	ps.inFlight.Add(delta)
+}
+
+func (ps *ProxyStats) AddUpstreamInFlight(delta int64) {
+	ps.upstreamInFlight.Add(delta)
 }
 
 func (ps *ProxyStats) GetStats() (uint64, uint64) {
-	ps.RLock()
-	defer ps.RUnlock()
-	return ps.clients, ps.bytes
+	return ps.clients.Load(), ps.bytes.Load()
+}
+
+// GetResponses returns the number of responses sent, by status code.
+func (ps *ProxyStats) GetResponses() map[int]uint64 {
+	return ps.responses.snapshot()
+}
+
+// GetRejected returns the number of failed requests, indexed by camo.Reason.
+func (ps *ProxyStats) GetRejected() [camo.NumReasons]uint64 {
+	return ps.rejected.snapshot()
+}
+
+// GetUpstreamLatency returns the number of upstream requests made, and the
+// total time spent waiting on them.
+func (ps *ProxyStats) GetUpstreamLatency() (uint64, time.Duration) {
+	return ps.upstreams.Load(), time.Duration(ps.latency.Load())
+}
+
+// GetInFlight returns the number of client requests, and upstream requests,
+// currently in progress.
+func (ps *ProxyStats) GetInFlight() (int64, int64) {
+	return ps.inFlight.Load(), ps.upstreamInFlight.Load()
+}
+
+// Snapshot is a point in time copy of the values tracked by a ProxyStats,
+// along with some general process stats. It is the json form of the
+// StatsHandler output. There are no cache stats, as the Proxy doesn't cache
+// responses.
+type Snapshot struct {
+	Version              string            `json:"version,omitempty"`
+	UptimeSeconds        float64           `json:"uptime_seconds"`
+	Goroutines           int               `json:"goroutines"`
+	InFlight             int64             `json:"in_flight"`
+	UpstreamInFlight     int64             `json:"upstream_in_flight"`
+	ClientsServed        uint64            `json:"clients_served"`
+	BytesServed          uint64            `json:"bytes_served"`
+	UpstreamRequests     uint64            `json:"upstream_requests"`
+	UpstreamLatencyAvgMs float64           `json:"upstream_latency_avg_ms"`
+	Responses            map[string]uint64 `json:"responses"`
+	Rejected             map[string]uint64 `json:"rejected"`
+	ClientRates          Rates             `json:"clients_per_second"`
+	ByteRates            Rates             `json:"bytes_per_second"`
+	RejectedRates        Rates             `json:"rejected_per_second"`
+}
+
+// Snapshot returns a Snapshot of the current stats.
+func (ps *ProxyStats) Snapshot() Snapshot {
+	c, b := ps.GetStats()
+	n, lat := ps.GetUpstreamLatency()
+	inFlight, upstreamInFlight := ps.GetInFlight()
+	snap := Snapshot{
+		Version:          ps.ServerVersion,
+		UptimeSeconds:    time.Since(startTime).Seconds(),
+		Goroutines:       runtime.NumGoroutine(),
+		InFlight:         inFlight,
+		UpstreamInFlight: upstreamInFlight,
+		ClientsServed:    c,
+		BytesServed:      b,
+		UpstreamRequests: n,
+		Responses:        make(map[string]uint64),
+		Rejected:         make(map[string]uint64),
+		ClientRates:      ps.clientRates.rates(),
+		ByteRates:        ps.byteRates.rates(),
+		RejectedRates:    ps.rejectedRates.rates(),
+	}
+	if n > 0 {
+		snap.UpstreamLatencyAvgMs = float64(lat/time.Duration(n)) / float64(time.Millisecond)
+	}
+	for code, v := range ps.GetResponses() {
+		snap.Responses[strconv.Itoa(code)] = v
+	}
+	rejected := ps.GetRejected()
+	for i := 1; i < camo.NumReasons; i++ {
+		snap.Rejected[camo.Reason(i).String()] = rejected[i]
+	}
+	return snap
+}
+
+// wantsJSON reports whether the request asked for json output, either with
+// a format=json query parameter or an Accept header.
+func wantsJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
 }
 
 // StatsHandler returns an http.HandlerFunc that returns running totals and
-// stats about the server.
+// stats about the server. The output is the plain text clients and bytes
+// served, unless json is requested via a format=json query parameter or the
+// Accept header, or the extended plain text output via format=extended.
 func StatsHandler(ps *ProxyStats) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if wantsJSON(r) {
+			b, err := json.Marshal(ps.Snapshot())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write(b)
+			return
+		}
+
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(200)
 		c, b := ps.GetStats()
 		fmt.Fprintf(w, "ClientsServed, BytesServed\n%d, %d\n", c, b)
+		if r.URL.Query().Get("format") == "extended" {
+			writeExtendedStats(w, ps)
+		}
+	}
+}
+
+// writeExtendedStats writes the upstream latency, response and rejection
+// counts of ps to w, as extra sections of the plain text output.
+func writeExtendedStats(w io.Writer, ps *ProxyStats) {
+	n, lat := ps.GetUpstreamLatency()
+	var avg time.Duration
+	if n > 0 {
+		avg = lat / time.Duration(n)
+	}
+	fmt.Fprintf(w, "\nUpstreamRequests, UpstreamLatencyAvgMs\n%d, %.3f\n",
+		n, float64(avg)/float64(time.Millisecond))
+
+	responses := ps.GetResponses()
+	codes := make([]int, 0, len(responses))
+	for code := range responses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprintf(w, "\nStatus, Responses\n")
+	for _, code := range codes {
+		fmt.Fprintf(w, "%d, %d\n", code, responses[code])
+	}
+
+	rejected := ps.GetRejected()
+	fmt.Fprintf(w, "\nReason, Rejected\n")
+	for i := 1; i < camo.NumReasons; i++ {
+		fmt.Fprintf(w, "%s, %d\n", camo.Reason(i), rejected[i])
 	}
 }
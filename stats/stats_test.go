@@ -0,0 +1,187 @@
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/camo"
+	"github.com/stretchr/testify/assert"
+)
+
+// ensure ProxyStats receives the extended metrics
+var (
+	_ camo.ProxyMetricsExtended = &ProxyStats{}
+	_ camo.ProxyMetricsInFlight = &ProxyStats{}
+)
+
+func TestStatsHandler(t *testing.T) {
+	t.Parallel()
+	ps := &ProxyStats{}
+	ps.AddServed()
+	ps.AddServed()
+	ps.AddBytes(100)
+	ps.AddResponse(200)
+	ps.AddResponse(403)
+	ps.AddRejected(camo.ReasonBadSignature)
+	ps.AddUpstreamLatency(10 * time.Millisecond)
+	ps.AddUpstreamLatency(30 * time.Millisecond)
+
+	req, err := http.NewRequest("GET", "http://example.com/status", nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	StatsHandler(ps)(record, req)
+	assert.Equal(t, record.Code, 200)
+	// the default output is unchanged, for existing parsers
+	assert.Equal(t, "ClientsServed, BytesServed\n2, 100\n", record.Body.String())
+
+	req, err = http.NewRequest("GET", "http://example.com/status?format=extended", nil)
+	assert.Nil(t, err)
+	record = httptest.NewRecorder()
+	StatsHandler(ps)(record, req)
+	assert.Equal(t, record.Code, 200)
+
+	body := record.Body.String()
+	assert.True(t, strings.HasPrefix(body, "ClientsServed, BytesServed\n2, 100\n"), "unexpected body: %s", body)
+	assert.Contains(t, body, "UpstreamRequests, UpstreamLatencyAvgMs\n2, 20.000\n")
+	assert.Contains(t, body, "Status, Responses\n200, 1\n403, 1\n")
+	assert.Contains(t, body, "bad-signature, 1\n")
+	assert.Contains(t, body, "allow-list, 0\n")
+}
+
+func TestStatsHandlerJSON(t *testing.T) {
+	t.Parallel()
+	ps := NewProxyStats()
+	ps.ServerVersion = "1.2.3"
+	ps.AddServed()
+	ps.AddBytes(100)
+	ps.AddResponse(404)
+	ps.AddRejected(camo.ReasonAllowList)
+	ps.AddInFlight(1)
+	ps.tickRates()
+
+	for _, url := range []string{"http://example.com/status?format=json", "http://example.com/status"} {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Accept", "application/json")
+		record := httptest.NewRecorder()
+		StatsHandler(ps)(record, req)
+		assert.Equal(t, record.Code, 200)
+		assert.Equal(t, record.HeaderMap.Get("Content-Type"), "application/json")
+
+		var snap Snapshot
+		assert.Nil(t, json.Unmarshal(record.Body.Bytes(), &snap))
+		assert.Equal(t, snap.Version, "1.2.3")
+		assert.Equal(t, snap.ClientsServed, uint64(1))
+		assert.Equal(t, snap.BytesServed, uint64(100))
+		assert.Equal(t, snap.InFlight, int64(1))
+		assert.True(t, snap.Goroutines > 0)
+		assert.True(t, snap.UptimeSeconds > 0)
+		assert.Equal(t, snap.Responses["404"], uint64(1))
+		assert.Equal(t, snap.Rejected["allow-list"], uint64(1))
+		assert.Equal(t, snap.Rejected["bad-signature"], uint64(0))
+		assert.Equal(t, snap.ClientRates.M1, 0.2)
+		assert.Equal(t, snap.ByteRates.M15, 20.0)
+	}
+
+	// format=text wins over the accept header
+	req, err := http.NewRequest("GET", "http://example.com/status?format=text", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "application/json")
+	record := httptest.NewRecorder()
+	StatsHandler(ps)(record, req)
+	assert.Equal(t, record.HeaderMap.Get("Content-Type"), "text/plain; charset=utf-8")
+}
+
+func TestRollingRates(t *testing.T) {
+	t.Parallel()
+	rr := newRollingRates()
+	// 10/sec for a minute
+	var total uint64
+	for i := 0; i < 12; i++ {
+		total += 50
+		rr.tick(total)
+	}
+	r := rr.rates()
+	assert.Equal(t, r.M1, 10.0)
+	assert.Equal(t, r.M15, 10.0)
+
+	// then nothing for a minute. the 1m rate decays by 1/e, the others less.
+	for i := 0; i < 12; i++ {
+		rr.tick(total)
+	}
+	r = rr.rates()
+	assert.InDelta(t, 10/math.E, r.M1, 0.0001)
+	assert.True(t, r.M5 > r.M1)
+	assert.True(t, r.M15 > r.M5)
+}
+
+// mutexProxyStats is the previous mutex based ProxyStats implementation,
+// which the Proxy called from a new goroutine per metric. It is kept here to
+// benchmark against.
+type mutexProxyStats struct {
+	sync.RWMutex
+	clients uint64
+	bytes   uint64
+}
+
+func (ps *mutexProxyStats) AddServed() {
+	ps.Lock()
+	ps.clients++
+	ps.Unlock()
+}
+
+func (ps *mutexProxyStats) AddBytes(bc int64) {
+	if bc <= 0 {
+		return
+	}
+	ps.Lock()
+	ps.bytes += uint64(bc)
+	ps.Unlock()
+}
+
+func BenchmarkMutexProxyStats(b *testing.B) {
+	ps := &mutexProxyStats{}
+	var wg sync.WaitGroup
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			wg.Add(2)
+			go func() {
+				ps.AddServed()
+				wg.Done()
+			}()
+			go func() {
+				ps.AddBytes(1024)
+				wg.Done()
+			}()
+		}
+	})
+	wg.Wait()
+}
+
+func BenchmarkProxyStats(b *testing.B) {
+	ps := &ProxyStats{}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ps.AddServed()
+			ps.AddBytes(1024)
+		}
+	})
+}
+
+func BenchmarkProxyStatsExtended(b *testing.B) {
+	ps := &ProxyStats{}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ps.AddServed()
+			ps.AddUpstreamLatency(time.Millisecond)
+			ps.AddResponse(200)
+			ps.AddBytes(1024)
+		}
+	})
+}
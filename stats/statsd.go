@@ -0,0 +1,255 @@
+package stats
+
+import (
+	"bytes"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cactus/go-camo/camo"
+)
+
+// maximum statsd udp packet payload. fits in a 1500 byte ethernet mtu after
+// ip/udp headers.
+const statsdMaxPacket = 1432
+
+// maximum timing samples kept between flushes. Past this, a random sample
+// of them is kept, and sent with a sample rate.
+const statsdMaxTimings = 200
+
+// minimum time between logging flush errors
+const statsdErrorLogInterval = time.Minute
+
+// StatsdStats is a camo.ProxyMetrics collector that batches counters and
+// timings in memory, and periodically ships them over UDP to a StatsD
+// server. If tags are given, they are appended to each metric in the
+// DogStatsD format. It implements camo.ProxyMetricsExtended and
+// camo.ProxyMetricsInFlight as well. Counters and gauges are lock-free, only
+// the batch of timing samples is guarded by a mutex. At most statsdMaxTimings
+// timing samples are kept per interval, so memory and packets sent don't
+// grow with the request rate.
+type StatsdStats struct {
+	conn   net.Conn
+	prefix string
+	tags   string
+	done   chan struct{}
+
+	closeOnce sync.Once
+
+	requests         atomic.Uint64
+	bytes            atomic.Uint64
+	responses        statusCounters
+	rejected         reasonCounters
+	inFlight         atomic.Int64
+	upstreamInFlight atomic.Int64
+
+	mu      sync.Mutex
+	timings []float64
+	// number of timing samples seen since the last flush
+	timingsSeen int
+}
+
+// NewStatsdStats returns a new StatsdStats that sends to the statsd server
+// at addr (host:port) every interval. Metric names are prefixed with prefix
+// (if not empty), and tags are sent in the DogStatsD format (eg.
+// "env:prod"). If interval is zero, metrics are only sent when Flush is
+// called.
+func NewStatsdStats(addr, prefix string, tags []string, interval time.Duration) (*StatsdStats, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	ss := &StatsdStats{
+		conn:   conn,
+		prefix: prefix,
+		done:   make(chan struct{}),
+	}
+	if len(tags) > 0 {
+		ss.tags = "|#" + strings.Join(tags, ",")
+	}
+
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			var lastLogged time.Time
+			suppressed := 0
+			for {
+				select {
+				case <-ticker.C:
+					err := ss.Flush()
+					if err == nil {
+						continue
+					}
+					if time.Since(lastLogged) < statsdErrorLogInterval {
+						suppressed++
+						continue
+					}
+					slog.Warn("could not send statsd metrics", "error", err,
+						"suppressed_errors", suppressed)
+					lastLogged = time.Now()
+					suppressed = 0
+				case <-ss.done:
+					return
+				}
+			}
+		}()
+	}
+	return ss, nil
+}
+
+func (ss *StatsdStats) AddServed() {
+	ss.requests.Add(1)
+}
+
+func (ss *StatsdStats) AddBytes(bc int64) {
+	if bc <= 0 {
+		return
+	}
+	ss.bytes.Add(uint64(bc))
+}
+
+func (ss *StatsdStats) AddResponse(code int) {
+	ss.responses.add(code)
+}
+
+func (ss *StatsdStats) AddRejected(reason camo.Reason) {
+	ss.rejected.add(reason)
+}
+
+func (ss *StatsdStats) AddUpstreamLatency(d time.Duration) {
+	t := float64(d) / float64(time.Millisecond)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.timingsSeen++
+	if len(ss.timings) < statsdMaxTimings {
+		ss.timings = append(ss.timings, t)
+		return
+	}
+	// reservoir sampling, so each sample is equally likely to be kept
+	if i := rand.Intn(ss.timingsSeen); i < statsdMaxTimings {
+		ss.timings[i] = t
+	}
+}
+
+func (ss *StatsdStats) AddInFlight(delta int64) {
+	ss.inFlight.Add(delta)
+}
+
+func (ss *StatsdStats) AddUpstreamInFlight(delta int64) {
+	ss.upstreamInFlight.Add(delta)
+}
+
+// Flush sends all batched metrics to the statsd server, and resets the
+// batched counters and timings. Counters that could not be sent are kept for
+// the next Flush; timing samples are dropped.
+func (ss *StatsdStats) Flush() error {
+	ss.mu.Lock()
+	timings, seen := ss.timings, ss.timingsSeen
+	ss.timings, ss.timingsSeen = nil, 0
+	ss.mu.Unlock()
+
+	// counters are sent as the delta since the last flush
+	var lines []statsdLine
+	addCounter := func(name string, c *atomic.Uint64) {
+		if v := c.Swap(0); v > 0 {
+			lines = append(lines, statsdLine{
+				text:    ss.line(name, strconv.FormatUint(v, 10), "c"),
+				counter: c,
+				value:   v,
+			})
+		}
+	}
+	addCounter("requests", &ss.requests)
+	addCounter("bytes", &ss.bytes)
+	for code := range ss.responses {
+		addCounter("responses."+strconv.Itoa(code), &ss.responses[code])
+	}
+	for i := range ss.rejected {
+		addCounter("errors."+camo.Reason(i).String(), &ss.rejected[i])
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].text < lines[j].text })
+
+	timingKind := "ms"
+	if len(timings) < seen {
+		rate := float64(len(timings)) / float64(seen)
+		timingKind += "|@" + strconv.FormatFloat(rate, 'f', -1, 64)
+	}
+	for _, t := range timings {
+		lines = append(lines, statsdLine{text: ss.line("upstream.latency",
+			strconv.FormatFloat(t, 'f', 3, 64), timingKind)})
+	}
+	lines = append(lines,
+		statsdLine{text: ss.line("in_flight", strconv.FormatInt(ss.inFlight.Load(), 10), "g")},
+		statsdLine{text: ss.line("upstream.in_flight", strconv.FormatInt(ss.upstreamInFlight.Load(), 10), "g")})
+
+	// pack as many lines as will fit into each packet
+	var buf bytes.Buffer
+	start := 0
+	for i, l := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(l.text) > statsdMaxPacket {
+			if _, err := ss.conn.Write(buf.Bytes()); err != nil {
+				restoreCounters(lines[start:])
+				return err
+			}
+			buf.Reset()
+			start = i
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(l.text)
+	}
+	if buf.Len() > 0 {
+		if _, err := ss.conn.Write(buf.Bytes()); err != nil {
+			restoreCounters(lines[start:])
+			return err
+		}
+	}
+	return nil
+}
+
+// statsdLine is a metric line, and the counter (if any) it was taken from.
+type statsdLine struct {
+	text    string
+	counter *atomic.Uint64
+	value   uint64
+}
+
+// restoreCounters adds the values of unsent lines back to their counters.
+func restoreCounters(lines []statsdLine) {
+	for _, l := range lines {
+		if l.counter != nil {
+			l.counter.Add(l.value)
+		}
+	}
+}
+
+func (ss *StatsdStats) line(name, value, kind string) string {
+	return ss.prefix + name + ":" + value + "|" + kind + ss.tags
+}
+
+// Close stops the periodic flushing, sends any remaining metrics, and closes
+// the connection. Calls after the first do nothing.
+func (ss *StatsdStats) Close() error {
+	var err error
+	ss.closeOnce.Do(func() {
+		close(ss.done)
+		err = ss.Flush()
+		if cerr := ss.conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
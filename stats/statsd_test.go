@@ -0,0 +1,184 @@
+package stats
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-camo/camo"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ camo.ProxyMetricsExtended = &StatsdStats{}
+	_ camo.ProxyMetricsInFlight = &StatsdStats{}
+)
+
+func readPackets(t *testing.T, l net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, 2048)
+	for {
+		l.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		assert.True(t, n <= statsdMaxPacket, "packet too large: %d", n)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	return lines
+}
+
+func TestStatsdFlush(t *testing.T) {
+	t.Parallel()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	ss, err := NewStatsdStats(l.LocalAddr().String(), "gocamo", []string{"env:test", "dc:1"}, 0)
+	assert.Nil(t, err)
+	defer ss.Close()
+
+	ss.AddServed()
+	ss.AddServed()
+	ss.AddBytes(1234)
+	ss.AddResponse(200)
+	ss.AddRejected(camo.ReasonBadSignature)
+	ss.AddUpstreamLatency(1500 * time.Microsecond)
+	ss.AddInFlight(1)
+	assert.Nil(t, ss.Flush())
+
+	lines := readPackets(t, l)
+	assert.Equal(t, []string{
+		"gocamo.bytes:1234|c|#env:test,dc:1",
+		"gocamo.errors.bad-signature:1|c|#env:test,dc:1",
+		"gocamo.requests:2|c|#env:test,dc:1",
+		"gocamo.responses.200:1|c|#env:test,dc:1",
+		"gocamo.upstream.latency:1.500|ms|#env:test,dc:1",
+		"gocamo.in_flight:1|g|#env:test,dc:1",
+		"gocamo.upstream.in_flight:0|g|#env:test,dc:1",
+	}, lines)
+
+	// counters are reset after a flush
+	assert.Nil(t, ss.Flush())
+	lines = readPackets(t, l)
+	assert.Equal(t, []string{
+		"gocamo.in_flight:1|g|#env:test,dc:1",
+		"gocamo.upstream.in_flight:0|g|#env:test,dc:1",
+	}, lines)
+}
+
+// failingConn is a net.Conn whose writes fail.
+type failingConn struct {
+	net.Conn
+}
+
+func (failingConn) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestStatsdFlushError(t *testing.T) {
+	t.Parallel()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	ss, err := NewStatsdStats(l.LocalAddr().String(), "", nil, 0)
+	assert.Nil(t, err)
+	defer ss.Close()
+
+	// counters that weren't sent are kept for the next flush
+	ss.AddServed()
+	ss.AddResponse(200)
+	conn := ss.conn
+	ss.conn = failingConn{conn}
+	assert.NotNil(t, ss.Flush())
+	ss.AddServed()
+	ss.conn = conn
+	assert.Nil(t, ss.Flush())
+
+	lines := readPackets(t, l)
+	assert.Equal(t, []string{
+		"requests:2|c",
+		"responses.200:1|c",
+		"in_flight:0|g",
+		"upstream.in_flight:0|g",
+	}, lines)
+}
+
+func TestStatsdCloseTwice(t *testing.T) {
+	t.Parallel()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	ss, err := NewStatsdStats(l.LocalAddr().String(), "", nil, time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, ss.Close())
+	assert.Nil(t, ss.Close())
+}
+
+func TestStatsdPacketSplit(t *testing.T) {
+	t.Parallel()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	ss, err := NewStatsdStats(l.LocalAddr().String(), "", nil, 0)
+	assert.Nil(t, err)
+	defer ss.Close()
+
+	for i := 0; i < 100; i++ {
+		ss.AddUpstreamLatency(time.Millisecond)
+	}
+	assert.Nil(t, ss.Flush())
+
+	lines := readPackets(t, l)
+	assert.Equal(t, 102, len(lines))
+	assert.Equal(t, "upstream.latency:1.000|ms", lines[0])
+}
+
+func TestStatsdTimingSampling(t *testing.T) {
+	t.Parallel()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	ss, err := NewStatsdStats(l.LocalAddr().String(), "", []string{"a:b"}, 0)
+	assert.Nil(t, err)
+	defer ss.Close()
+
+	// past the limit, a sample is kept and sent with its sample rate
+	for i := 0; i < 4*statsdMaxTimings; i++ {
+		ss.AddUpstreamLatency(time.Millisecond)
+	}
+	assert.Equal(t, statsdMaxTimings, len(ss.timings))
+	assert.Nil(t, ss.Flush())
+
+	lines := readPackets(t, l)
+	assert.Equal(t, statsdMaxTimings+2, len(lines))
+	assert.Equal(t, "upstream.latency:1.000|ms|@0.25|#a:b", lines[0])
+	assert.Equal(t, 0, len(ss.timings))
+	assert.Equal(t, 0, ss.timingsSeen)
+}
+
+func TestStatsdInterval(t *testing.T) {
+	t.Parallel()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	ss, err := NewStatsdStats(l.LocalAddr().String(), "p.", nil, 10*time.Millisecond)
+	assert.Nil(t, err)
+	defer ss.Close()
+	ss.AddServed()
+
+	// gauges are sent every interval, so just read a single packet
+	buf := make([]byte, 2048)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := l.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Contains(t, strings.Split(string(buf[:n]), "\n"), "p.requests:1|c")
+}
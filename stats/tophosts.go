@@ -0,0 +1,239 @@
+package stats
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/cactus/go-camo/camo"
+)
+
+// maximum number of independently locked shards in a sketch
+const sketchMaxShards = 16
+
+// minimum capacity of each shard. Smaller sketches use fewer shards, so that
+// a host isn't evicted just because its shard is full while others are not.
+const sketchMinShardCapacity = 64
+
+// HostCount is an estimated count for an upstream host. The true count is
+// between Count-Error and Count.
+type HostCount struct {
+	Host  string `json:"host"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+type sketchShard struct {
+	sync.Mutex
+	capacity int
+	entries  map[string]*HostCount
+}
+
+// sketch is a weighted space-saving sketch (Metwally et al.) that tracks the
+// heaviest hitters in bounded memory. Large sketches hash hosts to shards,
+// each with their own lock and capacity, to reduce contention.
+type sketch struct {
+	shards []sketchShard
+}
+
+// newSketch returns a sketch that tracks at least capacity hosts. With more
+// than one shard, the capacity is rounded up to a multiple of the number of
+// shards.
+func newSketch(capacity int) *sketch {
+	n := capacity / sketchMinShardCapacity
+	if n < 1 {
+		n = 1
+	}
+	if n > sketchMaxShards {
+		n = sketchMaxShards
+	}
+	per := (capacity + n - 1) / n
+	if per < 1 {
+		per = 1
+	}
+	s := &sketch{shards: make([]sketchShard, n)}
+	for i := range s.shards {
+		s.shards[i].capacity = per
+		s.shards[i].entries = make(map[string]*HostCount, per)
+	}
+	return s
+}
+
+func (s *sketch) shard(host string) *sketchShard {
+	if len(s.shards) == 1 {
+		return &s.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return &s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *sketch) add(host string, weight uint64) {
+	if weight == 0 {
+		return
+	}
+	sh := s.shard(host)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if e, ok := sh.entries[host]; ok {
+		e.Count += weight
+		return
+	}
+	if len(sh.entries) < sh.capacity {
+		sh.entries[host] = &HostCount{Host: host, Count: weight}
+		return
+	}
+
+	// replace the minimum entry. the newcomer inherits its count as the
+	// possible overestimation.
+	var min *HostCount
+	for _, e := range sh.entries {
+		if min == nil || e.Count < min.Count {
+			min = e
+		}
+	}
+	delete(sh.entries, min.Host)
+	sh.entries[host] = &HostCount{Host: host, Count: min.Count + weight, Error: min.Count}
+}
+
+// top returns up to n entries with the highest counts.
+func (s *sketch) top(n int) []HostCount {
+	var all []HostCount
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.Lock()
+		for _, e := range sh.entries {
+			all = append(all, *e)
+		}
+		sh.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Count != all[j].Count {
+			return all[i].Count > all[j].Count
+		}
+		return all[i].Host < all[j].Host
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (s *sketch) reset() {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.Lock()
+		sh.entries = make(map[string]*HostCount, sh.capacity)
+		sh.Unlock()
+	}
+}
+
+// TopHosts tracks the upstream hosts responsible for the most requests,
+// bytes, errors, and rejections, in bounded memory. It implements
+// camo.ProxyMetricsHosts (along with the required camo.ProxyMetrics methods,
+// which are no-ops).
+type TopHosts struct {
+	requests *sketch
+	bytes    *sketch
+	errors   *sketch
+	rejected *sketch
+}
+
+// NewTopHosts returns a new TopHosts that tracks at least capacity hosts for
+// each of requests, bytes, errors, and rejections. Counts for hosts outside
+// the top capacity are estimates.
+func NewTopHosts(capacity int) *TopHosts {
+	return &TopHosts{
+		requests: newSketch(capacity),
+		bytes:    newSketch(capacity),
+		errors:   newSketch(capacity),
+		rejected: newSketch(capacity),
+	}
+}
+
+func (th *TopHosts) AddServed()        {}
+func (th *TopHosts) AddBytes(bc int64) {}
+
+// AddHost counts a request for host. Requests refused by the allow or deny
+// list are counted as rejected, and other failures as errors.
+func (th *TopHosts) AddHost(host string, bc int64, reason camo.Reason) {
+	th.requests.add(host, 1)
+	if bc > 0 {
+		th.bytes.add(host, uint64(bc))
+	}
+	switch reason {
+	case camo.ReasonNone:
+	case camo.ReasonAllowList, camo.ReasonDenyList:
+		th.rejected.add(host, 1)
+	default:
+		th.errors.add(host, 1)
+	}
+}
+
+// TopHostsReport holds the top hosts by each tracked count.
+type TopHostsReport struct {
+	Requests []HostCount `json:"requests"`
+	Bytes    []HostCount `json:"bytes"`
+	Errors   []HostCount `json:"errors"`
+	Rejected []HostCount `json:"rejected"`
+}
+
+// Top returns the n hosts with the most requests, bytes, errors, and
+// rejections.
+func (th *TopHosts) Top(n int) TopHostsReport {
+	return TopHostsReport{
+		Requests: th.requests.top(n),
+		Bytes:    th.bytes.top(n),
+		Errors:   th.errors.top(n),
+		Rejected: th.rejected.top(n),
+	}
+}
+
+// Reset clears all tracked hosts.
+func (th *TopHosts) Reset() {
+	th.requests.reset()
+	th.bytes.reset()
+	th.errors.reset()
+	th.rejected.reset()
+}
+
+// TopHostsHandler returns an http.HandlerFunc that returns a json
+// TopHostsReport on GET (with an optional n query parameter, default 10),
+// and resets the tracked hosts on DELETE.
+func TopHostsHandler(th *TopHosts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+		case "DELETE":
+			th.Reset()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			http.Error(w, "Method Not Allowed", 405)
+			return
+		}
+
+		n := 10
+		if v := r.URL.Query().Get("n"); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 1 {
+				http.Error(w, "Bad n", http.StatusBadRequest)
+				return
+			}
+			n = i
+		}
+
+		b, err := json.Marshal(th.Top(n))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(b)
+	}
+}
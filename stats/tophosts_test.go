@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cactus/go-camo/camo"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ camo.ProxyMetricsHosts = &TopHosts{}
+	_ camo.ProxyMetricsHosts = Multi{}
+)
+
+func TestTopHosts(t *testing.T) {
+	t.Parallel()
+	th := NewTopHosts(32)
+
+	// a long tail of small hosts, interleaved with a few heavy ones
+	for i := 0; i < 1000; i++ {
+		th.AddHost(fmt.Sprintf("tail%d.example.com", i), 10, camo.ReasonNone)
+		if i%2 == 0 {
+			th.AddHost("busy.example.com", 10, camo.ReasonNone)
+		}
+		if i%10 == 0 {
+			th.AddHost("big.example.com", 1<<20, camo.ReasonNone)
+			th.AddHost("broken.example.com", 0, camo.ReasonUpstreamTimeout)
+			th.AddHost("denied.example.com", 0, camo.ReasonAllowList)
+		}
+	}
+
+	r := th.Top(3)
+	assert.Equal(t, 3, len(r.Requests))
+	assert.Equal(t, "busy.example.com", r.Requests[0].Host)
+	assert.True(t, r.Requests[0].Count >= 500)
+	assert.True(t, r.Requests[0].Count-r.Requests[0].Error <= 500)
+	assert.Equal(t, "big.example.com", r.Bytes[0].Host)
+	assert.Equal(t, uint64(100<<20), r.Bytes[0].Count)
+	assert.Equal(t, 1, len(r.Errors))
+	assert.Equal(t, "broken.example.com", r.Errors[0].Host)
+	assert.Equal(t, uint64(100), r.Errors[0].Count)
+	assert.Equal(t, 1, len(r.Rejected))
+	assert.Equal(t, "denied.example.com", r.Rejected[0].Host)
+	assert.Equal(t, uint64(100), r.Rejected[0].Count)
+
+	th.Reset()
+	r = th.Top(3)
+	assert.Equal(t, 0, len(r.Requests))
+}
+
+func TestSketchCapacity(t *testing.T) {
+	t.Parallel()
+	for _, capacity := range []int{1, 10, 63, 64, 200, 1000, 5000} {
+		s := newSketch(capacity)
+		total := 0
+		for i := range s.shards {
+			total += s.shards[i].capacity
+			assert.True(t, len(s.shards) == 1 || s.shards[i].capacity >= sketchMinShardCapacity, "capacity %d", capacity)
+		}
+		assert.True(t, total >= capacity, "capacity %d", capacity)
+		assert.True(t, len(s.shards) <= sketchMaxShards, "capacity %d", capacity)
+	}
+
+	// a small sketch keeps every host it has room for
+	s := newSketch(10)
+	for i := 0; i < 10; i++ {
+		s.add(fmt.Sprintf("host%d.example.com", i), uint64(i+1))
+	}
+	assert.Equal(t, 10, len(s.top(20)))
+	assert.Equal(t, uint64(0), s.top(20)[9].Error)
+}
+
+func TestTopHostsHandler(t *testing.T) {
+	t.Parallel()
+	th := NewTopHosts(10)
+	th.AddHost("a.example.com", 100, camo.ReasonNone)
+	th.AddHost("b.example.com", 200, camo.ReasonUpstreamStatus)
+
+	req, err := http.NewRequest("GET", "http://example.com/top-hosts?n=1", nil)
+	assert.Nil(t, err)
+	record := httptest.NewRecorder()
+	TopHostsHandler(th)(record, req)
+	assert.Equal(t, record.Code, 200)
+
+	var r TopHostsReport
+	assert.Nil(t, json.Unmarshal(record.Body.Bytes(), &r))
+	assert.Equal(t, 1, len(r.Requests))
+	assert.Equal(t, "b.example.com", r.Bytes[0].Host)
+
+	req, err = http.NewRequest("GET", "http://example.com/top-hosts?n=0", nil)
+	assert.Nil(t, err)
+	record = httptest.NewRecorder()
+	TopHostsHandler(th)(record, req)
+	assert.Equal(t, record.Code, 400)
+
+	req, err = http.NewRequest("DELETE", "http://example.com/top-hosts", nil)
+	assert.Nil(t, err)
+	record = httptest.NewRecorder()
+	TopHostsHandler(th)(record, req)
+	assert.Equal(t, record.Code, 204)
+	assert.Equal(t, 0, len(th.Top(10).Requests))
+}
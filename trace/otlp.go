@@ -0,0 +1,243 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maximum number of spans buffered between flushes. spans past this are
+// dropped, rather than growing without bound if the collector is down.
+const otlpMaxQueued = 8192
+
+// minimum time between logging flush errors
+const otlpErrorLogInterval = time.Minute
+
+// OTLPExporter is an Exporter that buffers finished spans in memory, and
+// periodically POSTs them to an OpenTelemetry collector using OTLP/HTTP with
+// json encoding.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	done        chan struct{}
+	closeOnce   sync.Once
+	dropped     atomic.Uint64
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewOTLPExporter returns a new OTLPExporter that sends spans to endpoint
+// (eg. "http://localhost:4318/v1/traces") every interval, with a
+// service.name resource attribute of serviceName. If interval is zero, spans
+// are only sent when Flush is called. Errors from periodic flushes are
+// logged, at most once per otlpErrorLogInterval.
+func NewOTLPExporter(endpoint, serviceName string, interval time.Duration) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		done:        make(chan struct{}),
+	}
+
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			var lastLogged time.Time
+			suppressed := 0
+			for {
+				select {
+				case <-ticker.C:
+					err := e.Flush()
+					if err == nil {
+						continue
+					}
+					if time.Since(lastLogged) < otlpErrorLogInterval {
+						suppressed++
+						continue
+					}
+					slog.Warn("could not send trace spans", "error", err,
+						"endpoint", e.endpoint, "suppressed_errors", suppressed)
+					lastLogged = time.Now()
+					suppressed = 0
+				case <-e.done:
+					return
+				}
+			}
+		}()
+	}
+	return e
+}
+
+// ExportSpan buffers s, to be sent on the next flush.
+func (e *OTLPExporter) ExportSpan(s *Span) {
+	e.mu.Lock()
+	if len(e.spans) >= otlpMaxQueued {
+		e.mu.Unlock()
+		e.dropped.Add(1)
+		return
+	}
+	e.spans = append(e.spans, s)
+	e.mu.Unlock()
+}
+
+// Dropped returns the number of spans dropped because the buffer was full.
+func (e *OTLPExporter) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+// Flush sends all buffered spans to the collector.
+func (e *OTLPExporter) Flush() error {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close stops the periodic flushing, and sends any remaining spans. Calls
+// after the first do nothing.
+func (e *OTLPExporter) Close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.done)
+		err = e.Flush()
+	})
+	return err
+}
+
+// the OTLP/HTTP json encoding. ids are hex, as a special case in the spec,
+// and 64 bit integers are strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func otlpAttr(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func (e *OTLPExporter) request(spans []*Span) *otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent.IsValid() {
+			o.ParentSpanID = s.Parent.String()
+		}
+		for _, a := range s.Attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(a.Key, a.Value))
+		}
+		if s.Failed {
+			// STATUS_CODE_ERROR
+			o.Status = &otlpStatus{Code: 2, Message: s.StatusMsg}
+		}
+		out = append(out, o)
+	}
+
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{otlpAttr("service.name", e.serviceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/cactus/go-camo"},
+				Spans: out,
+			}},
+		}},
+	}
+}
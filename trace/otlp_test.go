@@ -0,0 +1,89 @@
+package trace
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	t.Parallel()
+	bodies := make(chan []byte, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer ts.Close()
+
+	e := NewOTLPExporter(ts.URL+"/v1/traces", "go-camo-test", 0)
+	tr := NewTracer(e, 1)
+	start := time.Unix(1400000000, 0)
+	root := tr.Start("camo.request", KindServer, SpanContext{}, start)
+	root.SetAttr("http.status_code", 404)
+	root.SetAttr("camo.upstream_host", "example.org")
+	root.SetError("deny-list")
+	child := root.Child("decode", KindInternal, start)
+	child.Finish(start.Add(time.Millisecond))
+	root.Finish(start.Add(2 * time.Millisecond))
+
+	// nothing sent until flushed
+	assert.Equal(t, 0, len(bodies))
+	assert.Nil(t, e.Close())
+
+	var req otlpRequest
+	assert.Nil(t, json.Unmarshal(<-bodies, &req))
+	assert.Equal(t, 1, len(req.ResourceSpans))
+	rs := req.ResourceSpans[0]
+	assert.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	assert.Equal(t, "go-camo-test", *rs.Resource.Attributes[0].Value.StringValue)
+
+	spans := rs.ScopeSpans[0].Spans
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "decode", spans[0].Name)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, 32, len(spans[0].TraceID))
+
+	s := spans[1]
+	assert.Equal(t, "camo.request", s.Name)
+	assert.Equal(t, KindServer, s.Kind)
+	assert.Equal(t, "", s.ParentSpanID)
+	assert.Equal(t, "1400000000000000000", s.StartTimeUnixNano)
+	assert.Equal(t, "1400000000002000000", s.EndTimeUnixNano)
+	assert.Equal(t, "404", *s.Attributes[0].Value.IntValue)
+	assert.Equal(t, "example.org", *s.Attributes[1].Value.StringValue)
+	assert.Equal(t, 2, s.Status.Code)
+	assert.Equal(t, "deny-list", s.Status.Message)
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	e := NewOTLPExporter(ts.URL, "go-camo-test", 0)
+	NewTracer(e, 1).Start("a", KindServer, SpanContext{}, time.Now()).Finish(time.Now())
+	assert.NotNil(t, e.Flush())
+	// nothing left to send
+	assert.Nil(t, e.Flush())
+}
+
+func TestOTLPExporterCloseTwice(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	e := NewOTLPExporter(ts.URL, "go-camo-test", time.Hour)
+	assert.Nil(t, e.Close())
+	assert.NotPanics(t, func() { e.Close() })
+}
@@ -0,0 +1,184 @@
+// Package trace provides minimal distributed tracing: spans, W3C
+// traceparent propagation, and an OTLP/HTTP exporter.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand"
+	"time"
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether t is non-zero
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether s is non-zero
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// newTraceID returns a random, non-zero trace id. Ids are read from
+// crypto/rand, so they are unpredictable, and don't collide between
+// instances.
+func newTraceID() TraceID {
+	var t TraceID
+	for !t.IsValid() {
+		rand.Read(t[:])
+	}
+	return t
+}
+
+// newSpanID returns a random, non-zero span id, from crypto/rand.
+func newSpanID() SpanID {
+	var s SpanID
+	for !s.IsValid() {
+		rand.Read(s[:])
+	}
+	return s
+}
+
+// SpanContext is the part of a span that is propagated between services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether sc has both a trace and span id
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanKind is the OTLP kind of a span
+type SpanKind int
+
+// Span kinds
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Attr is a span attribute. Value may be a string, bool, int or int64.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a timed operation within a trace. Methods on a nil *Span are
+// no-ops, so that callers need not check whether a trace is being recorded.
+type Span struct {
+	Name    string
+	Kind    SpanKind
+	Context SpanContext
+	// Parent is the id of the parent span, zero for a root span
+	Parent SpanID
+	Start  time.Time
+	End    time.Time
+	Attrs  []Attr
+	// Failed marks the span as errored, with StatusMsg describing why
+	Failed    bool
+	StatusMsg string
+
+	tracer *Tracer
+}
+
+// SetAttr adds an attribute to the span
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s != nil {
+		s.Attrs = append(s.Attrs, Attr{key, value})
+	}
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(msg string) {
+	if s != nil {
+		s.Failed = true
+		s.StatusMsg = msg
+	}
+}
+
+// Child returns a new span, started at start, that is a child of s.
+func (s *Span) Child(name string, kind SpanKind, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		Name: name,
+		Kind: kind,
+		Context: SpanContext{
+			TraceID: s.Context.TraceID,
+			SpanID:  newSpanID(),
+			Sampled: true,
+		},
+		Parent: s.Context.SpanID,
+		Start:  start,
+		tracer: s.tracer,
+	}
+}
+
+// Finish ends the span at end, and hands it to the exporter.
+func (s *Span) Finish(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.End = end
+	s.tracer.exporter.ExportSpan(s)
+}
+
+// Exporter ships finished spans somewhere. ExportSpan is called
+// synchronously while handling a request, so must not block, and must be
+// goroutine safe.
+type Exporter interface {
+	ExportSpan(s *Span)
+}
+
+// Tracer starts spans, and sends them to an Exporter once finished.
+type Tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+}
+
+// NewTracer returns a new Tracer that exports to e. New traces are sampled
+// (recorded) with probability sampleRatio; traces continued from an
+// incoming traceparent follow the caller's sampling decision instead.
+func NewTracer(e Exporter, sampleRatio float64) *Tracer {
+	return &Tracer{exporter: e, sampleRatio: sampleRatio}
+}
+
+// Start starts a new span at start. If parent is valid, the span joins the
+// parent's trace, otherwise it starts a new trace. Start returns nil if the
+// trace is not sampled.
+func (t *Tracer) Start(name string, kind SpanKind, parent SpanContext, start time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		Name:   name,
+		Kind:   kind,
+		Start:  start,
+		tracer: t,
+	}
+	if parent.IsValid() {
+		if !parent.Sampled {
+			return nil
+		}
+		s.Context.TraceID = parent.TraceID
+		s.Parent = parent.SpanID
+	} else {
+		if t.sampleRatio <= 0 || mrand.Float64() >= t.sampleRatio {
+			return nil
+		}
+		s.Context.TraceID = newTraceID()
+	}
+	s.Context.SpanID = newSpanID()
+	s.Context.Sampled = true
+	return s
+}
@@ -0,0 +1,60 @@
+package trace
+
+import (
+	"encoding/hex"
+)
+
+// TraceparentHeader is the W3C trace context header
+const TraceparentHeader = "traceparent"
+
+// ParseTraceparent parses a W3C traceparent header value, eg.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". It returns false
+// if the value is malformed, or has an all-zero trace or span id.
+func ParseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+	// version 00 is exactly 55 chars. later versions may append fields.
+	if len(h) < 55 || h[2] != '-' || h[35] != '-' || h[52] != '-' {
+		return sc, false
+	}
+	version := h[0:2]
+	if version == "ff" || (version == "00" && len(h) != 55) ||
+		(len(h) > 55 && h[55] != '-') {
+		return sc, false
+	}
+	var v [1]byte
+	if !decodeLowerHex(v[:], version) ||
+		!decodeLowerHex(sc.TraceID[:], h[3:35]) ||
+		!decodeLowerHex(sc.SpanID[:], h[36:52]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeLowerHex(flags[:], h[53:55]) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&0x01 != 0
+	if !sc.IsValid() {
+		return sc, false
+	}
+	return sc, true
+}
+
+// decodeLowerHex decodes s into dst, which must be exactly the right size.
+// the spec only allows lowercase hex.
+func decodeLowerHex(dst []byte, s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 'A' && c <= 'F' {
+			return false
+		}
+	}
+	n, err := hex.Decode(dst, []byte(s))
+	return err == nil && n == len(dst)
+}
+
+// Traceparent returns sc formatted as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
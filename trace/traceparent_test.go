@@ -0,0 +1,89 @@
+package trace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	t.Parallel()
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	sc, ok = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, sc.Sampled)
+
+	// future versions may append fields
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(t, ok)
+
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+	} {
+		_, ok = ParseTraceparent(h)
+		assert.False(t, ok, h)
+	}
+}
+
+type recorder struct {
+	spans []*Span
+}
+
+func (r *recorder) ExportSpan(s *Span) {
+	r.spans = append(r.spans, s)
+}
+
+func TestTracerSampling(t *testing.T) {
+	t.Parallel()
+	r := &recorder{}
+	tr := NewTracer(r, 0)
+	var zero SpanContext
+
+	// not sampled
+	assert.Nil(t, tr.Start("a", KindServer, zero, time.Now()))
+
+	// parent decision wins
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s := tr.Start("a", KindServer, parent, time.Now())
+	assert.NotNil(t, s)
+	assert.Equal(t, parent.TraceID, s.Context.TraceID)
+	assert.Equal(t, parent.SpanID, s.Parent)
+	assert.NotEqual(t, parent.SpanID, s.Context.SpanID)
+
+	c := s.Child("b", KindInternal, time.Now())
+	c.Finish(time.Now())
+	s.Finish(time.Now())
+	assert.Equal(t, 2, len(r.spans))
+	assert.Equal(t, s.Context.SpanID, r.spans[0].Parent)
+
+	parent.Sampled = false
+	assert.Nil(t, NewTracer(r, 1).Start("a", KindServer, parent, time.Now()))
+
+	// always sampled, new trace
+	s = NewTracer(r, 1).Start("a", KindServer, zero, time.Now())
+	assert.NotNil(t, s)
+	assert.True(t, s.Context.IsValid())
+	assert.False(t, s.Parent.IsValid())
+
+	// nil spans are safe to use
+	var ns *Span
+	ns.SetAttr("a", "b")
+	ns.SetError("bad")
+	assert.Nil(t, ns.Child("c", KindInternal, time.Now()))
+	ns.Finish(time.Now())
+}